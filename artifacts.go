@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// validateArtifacts rejects artifact patterns that would reach outside the
+// remote path.
+func validateArtifacts(patterns []string) error {
+	for _, p := range patterns {
+		clean := path.Clean(filepath.ToSlash(p))
+		if p == "" || path.IsAbs(clean) || filepath.IsAbs(p) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("artifacts %q: must be a path inside the remote path", p)
+		}
+	}
+	return nil
+}
+
+// globPOSIX quotes pattern for a POSIX shell, leaving only the glob
+// characters * ? [ ] unquoted so the remote shell expands them.
+func globPOSIX(pattern string) string {
+	var b strings.Builder
+	lit := ""
+	flush := func() {
+		if lit != "" {
+			b.WriteString(shellQuotePOSIX(lit))
+			lit = ""
+		}
+	}
+	for _, r := range pattern {
+		if strings.ContainsRune("*?[]", r) {
+			flush()
+			b.WriteRune(r)
+		} else {
+			lit += string(r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// remoteArtifacts expands remote.Artifacts in remote.Path with the remote's
+// own shell and returns the matches relative to it. Patterns that match
+// nothing are left out.
+func remoteArtifacts(ctx context.Context, remote Remote) ([]string, error) {
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+
+	var sshArgs []string
+	sep := "\x00"
+	if remote.Shell == "powershell" {
+		patterns := make([]string, len(remote.Artifacts))
+		for i, p := range remote.Artifacts {
+			patterns[i] = quotePS(p)
+		}
+		ps := fmt.Sprintf(
+			`Set-Location -Path %s; foreach ($p in @(%s)) { Get-Item -Path $p -Force -ErrorAction SilentlyContinue | Resolve-Path -Relative }`,
+			quotePS(remote.Path), strings.Join(patterns, ","),
+		)
+		sshArgs = []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
+		sep = "\n"
+	} else {
+		patterns := make([]string, len(remote.Artifacts))
+		for i, p := range remote.Artifacts {
+			patterns[i] = globPOSIX(strings.TrimSuffix(p, "/"))
+		}
+		// An unmatched pattern stays as itself, so check each one exists.
+		cmdStr := fmt.Sprintf(`cd %s && for p in %s; do if [ -e "$p" ] || [ -L "$p" ]; then printf '%%s\0' "$p"; fi; done`,
+			shellQuotePOSIX(remote.Path), strings.Join(patterns, " "))
+		sshArgs = []string{target, cmdStr}
+	}
+
+	c := sshCommandContext(ctx, remote, sshArgs...)
+	c.Stderr = remote.stderr()
+	out, err := outputRemoteCmd(ctx, remote, c)
+	if err != nil {
+		return nil, fmt.Errorf("list artifacts: %w", err)
+	}
+
+	seen := map[string]bool{}
+	var matches []string
+	for _, m := range strings.Split(string(out), sep) {
+		m = strings.TrimSpace(m)
+		if remote.Shell == "powershell" {
+			m = strings.TrimPrefix(strings.ReplaceAll(m, `\`, "/"), "./")
+		}
+		if m == "" || seen[m] {
+			continue
+		}
+		seen[m] = true
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+// pullArtifacts copies remote.Artifacts from the remote path back into
+// remote.ArtifactsDir, keeping their paths, after a successful command.
+// Directories are copied whole.
+func pullArtifacts(ctx context.Context, remote Remote, opts Options) error {
+	if len(remote.Artifacts) == 0 {
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Fprintf(remote.stdout(), "==> Would pull artifacts into %s: %s\n", remote.ArtifactsDir, strings.Join(remote.Artifacts, " "))
+		return nil
+	}
+
+	matches, err := remoteArtifacts(ctx, remote)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		fmt.Fprintf(remote.stdout(), "==> No artifacts matched %s\n", strings.Join(remote.Artifacts, " "))
+		return nil
+	}
+	if err := os.MkdirAll(remote.ArtifactsDir, 0o755); err != nil {
+		return fmt.Errorf("create artifacts dir: %w", err)
+	}
+
+	fmt.Fprintf(remote.stdout(), "==> Pulling %d artifact(s) into %s...\n", len(matches), remote.ArtifactsDir)
+	if remote.Transport == transportNative {
+		if err := nativePull(ctx, remote, matches); err != nil {
+			return fmt.Errorf("pull artifacts: %w", err)
+		}
+		return nil
+	}
+	c := commandContext(ctx, "rsync", pullArgs(remote, opts)...)
+	c.Stdin = strings.NewReader(strings.Join(matches, "\n") + "\n")
+	c.Stdout = remote.stdout()
+	c.Stderr = remote.stderr()
+	if err := rsyncError(remote.stderr(), runCmd(c)); err != nil {
+		return fmt.Errorf("pull artifacts: %w", err)
+	}
+	return nil
+}
+
+// pullArgs builds the rsync argv (without "rsync" itself) that copies the
+// files listed on its stdin from the remote path into remote.ArtifactsDir.
+// Only how to reach the remote carries over from the sync; flags such as
+// --append and --hard-links are about what buildon sends.
+func pullArgs(remote Remote, opts Options) []string {
+	args := []string{"-az"}
+	if shell := rsyncShell(remote); shell != "" {
+		args = append(args, "-e", shell)
+	}
+	if opts.RsyncPath != "" {
+		args = append(args, "--rsync-path="+opts.RsyncPath)
+	}
+	if remote.CompressChoice != "" {
+		args = append(args, "--compress-choice="+remote.CompressChoice)
+	}
+	src := fmt.Sprintf("%s@%s:%s/", remote.User, remote.Host, strings.TrimSuffix(remote.Path, "/"))
+	return append(args, "-r", "--files-from=-", src, remote.ArtifactsDir)
+}
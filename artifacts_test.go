@@ -0,0 +1,22 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPullArgs(t *testing.T) {
+	remote := Remote{Host: "h", User: "u", Path: "src/", Port: 2222, CompressChoice: "zstd", ArtifactsDir: "out"}
+	opts := Options{Append: true, AppendVerify: true, HardLinks: true, PruneEmptyDirs: true, RsyncPath: "/opt/bin/rsync"}
+	args := pullArgs(remote, opts)
+
+	want := []string{"-az", "-e", "ssh -p 2222", "--rsync-path=/opt/bin/rsync", "--compress-choice=zstd", "-r", "--files-from=-", "u@h:src/", "out"}
+	if !slices.Equal(args, want) {
+		t.Errorf("pullArgs = %q, want %q", args, want)
+	}
+	for _, push := range []string{"--append", "--append-verify", "-H", "--prune-empty-dirs"} {
+		if slices.Contains(args, push) {
+			t.Errorf("pullArgs has %s, which is only for syncing", push)
+		}
+	}
+}
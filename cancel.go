@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// cancelGrace is how long a subprocess gets to exit after its context is
+// cancelled and it has been interrupted, before it is killed.
+const cancelGrace = 5 * time.Second
+
+// commandContext is exec.CommandContext, except that cancelling ctx first
+// interrupts the process, like Ctrl-C would, and only kills it if it is still
+// running cancelGrace later. Interrupting ssh or rsync lets them tear down
+// the connection instead of leaving the remote side hanging.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	c := exec.CommandContext(ctx, name, args...)
+	c.Cancel = func() error {
+		if runtime.GOOS == "windows" {
+			return c.Process.Kill()
+		}
+		return c.Process.Signal(os.Interrupt)
+	}
+	c.WaitDelay = cancelGrace
+	return c
+}
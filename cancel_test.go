@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandContextInterrupts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commandContext kills on windows")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := commandContext(ctx, "sh", "-c", `trap 'echo interrupted; exit 3' INT; echo started; sleep 10 >/dev/null & wait`)
+	var out strings.Builder
+	c.Stdout = &out
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	start := time.Now()
+	err := c.Wait()
+	if err == nil {
+		t.Fatal("Wait returned nil after cancel")
+	}
+	if took := time.Since(start); took >= cancelGrace {
+		t.Errorf("took %s to stop, want well under %s", took, cancelGrace)
+	}
+	if !strings.Contains(out.String(), "interrupted") {
+		t.Errorf("output %q: the process wasn't interrupted before being stopped", out.String())
+	}
+}
+
+func TestCommandContextKillsAfterGrace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for cancelGrace")
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("commandContext kills on windows")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// Ignores the interrupt, so only the kill stops it.
+	c := commandContext(ctx, "sh", "-c", `trap '' INT; echo ready; sleep 30 >/dev/null`)
+	out, err := c.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(out).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	start := time.Now()
+	if err := c.Wait(); err == nil {
+		t.Fatal("Wait returned nil after cancel")
+	}
+	if took := time.Since(start); took < cancelGrace-time.Second || took > cancelGrace+2*time.Second {
+		t.Errorf("took %s to stop, want about %s", took, cancelGrace)
+	}
+}
+
+func TestCommandContextUncancelled(t *testing.T) {
+	c := commandContext(context.Background(), "sh", "-c", "exit 0")
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+// fakeSSH puts an ssh on PATH that runs script instead of connecting.
+func fakeSSH(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRemoteStepsStopWhenCancelled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	fakeSSH(t, "exec sleep 30 >/dev/null")
+	remote := Remote{Host: "h", User: "u", Path: "p", Bootstrap: "make deps", PreSyncRemote: "true", out: io.Discard, errOut: io.Discard}
+
+	steps := map[string]func(context.Context) error{
+		"bootstrap": func(ctx context.Context) error { return runBootstrap(ctx, remote) },
+		"pre_sync_remote": func(ctx context.Context) error {
+			return runPreSyncRemote(ctx, remote, Options{})
+		},
+		"path_mode": func(ctx context.Context) error {
+			r := remote
+			r.PathMode = "0775"
+			return createRemotePath(ctx, r, Options{})
+		},
+	}
+	for name, step := range steps {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if err := step(ctx); err == nil {
+				t.Fatal("got nil error from a cancelled step")
+			}
+			if took := time.Since(start); took > 2*time.Second {
+				t.Errorf("took %s to stop after cancel", took)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// probedTools are the remote executables whose availability buildon records.
+var probedTools = []string{"rsync", "sha256sum", "tmux", "tail", "df"}
+
+// remoteCaps records which tools exist on a remote host. It is cached under
+// ~/.cache/buildon/<host>/caps.json so each host is only probed once.
+type remoteCaps struct {
+	Probed time.Time       `json:"probed"`
+	Tools  map[string]bool `json:"tools"`
+}
+
+// Has reports whether the remote has tool on its PATH.
+func (c remoteCaps) Has(tool string) bool {
+	return c.Tools[tool]
+}
+
+// Require returns a descriptive error when the remote lacks tool.
+func (c remoteCaps) Require(remote Remote, tool string) error {
+	if c.Has(tool) {
+		return nil
+	}
+	return fmt.Errorf("remote %s lacks %s (install it, or re-probe with --refresh-caps if that is stale)", remote.Host, tool)
+}
+
+// complete reports whether every tool in probedTools has been recorded, so
+// caches written by older versions get re-probed.
+func (c remoteCaps) complete() bool {
+	for _, t := range probedTools {
+		if _, ok := c.Tools[t]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func cacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home dir: %w", err)
+	}
+	return filepath.Join(home, ".cache", "buildon"), nil
+}
+
+// hostCacheDir returns the cache directory used for state about host.
+func hostCacheDir(host string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, strings.ReplaceAll(host, string(filepath.Separator), "_")), nil
+}
+
+// remoteCapabilities returns the cached capabilities for remote, probing over
+// ssh when there is no usable cache or refresh is set (as it is under
+// --record and --replay, so recordings always contain the probe).
+func remoteCapabilities(ctx context.Context, remote Remote, refresh bool) (remoteCaps, error) {
+	dir, err := hostCacheDir(remote.Host)
+	if err != nil {
+		return remoteCaps{}, err
+	}
+	path := filepath.Join(dir, "caps.json")
+
+	if !refresh {
+		if data, err := os.ReadFile(path); err == nil {
+			var caps remoteCaps
+			if err := json.Unmarshal(data, &caps); err == nil && caps.complete() {
+				return caps, nil
+			}
+		}
+	}
+
+	caps, err := probeCapabilities(ctx, remote)
+	if err != nil {
+		return remoteCaps{}, err
+	}
+
+	data, err := json.MarshalIndent(caps, "", "  ")
+	if err != nil {
+		return caps, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return caps, fmt.Errorf("create cache dir: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return caps, fmt.Errorf("write %s: %w", path, err)
+	}
+	return caps, nil
+}
+
+func probeCapabilities(ctx context.Context, remote Remote) (remoteCaps, error) {
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+
+	var sshArgs []string
+	if remote.Shell == "powershell" {
+		names := make([]string, len(probedTools))
+		for i, t := range probedTools {
+			names[i] = quotePS(t)
+		}
+		ps := fmt.Sprintf(
+			`foreach ($c in %s) { if (Get-Command $c -ErrorAction SilentlyContinue) { Write-Output ($c + '=1') } else { Write-Output ($c + '=0') } }`,
+			strings.Join(names, ","),
+		)
+		sshArgs = []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
+	} else {
+		cmdStr := fmt.Sprintf(
+			`for c in %s; do if command -v "$c" >/dev/null 2>&1; then echo "$c=1"; else echo "$c=0"; fi; done`,
+			strings.Join(probedTools, " "),
+		)
+		sshArgs = []string{target, cmdStr}
+	}
+
+	fmt.Fprintf(remote.stdout(), "==> Probing tools on %s...\n", target)
+	c := sshCommandContext(ctx, remote, sshArgs...)
+	c.Stderr = remote.stderr()
+	out, err := outputCmd(c)
+	if err != nil {
+		return remoteCaps{}, fmt.Errorf("probe remote tools: %w", err)
+	}
+
+	caps := remoteCaps{Probed: time.Now(), Tools: map[string]bool{}}
+	for _, line := range strings.Split(string(out), "\n") {
+		name, val, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok {
+			caps.Tools[name] = val == "1"
+		}
+	}
+	if !caps.complete() {
+		return remoteCaps{}, fmt.Errorf("probe remote tools: unexpected output %q", out)
+	}
+	return caps, nil
+}
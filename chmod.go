@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	octalMode    = regexp.MustCompile(`^[0-7]{3,4}$`)
+	symbolicMode = regexp.MustCompile(`^[ugoa]*[-+=][rwxXst]*(,[ugoa]*[-+=][rwxXst]*)*$`)
+)
+
+// validateChmodMap checks that every pattern is a valid glob and every mode
+// is something chmod accepts.
+func validateChmodMap(m map[string]string) error {
+	for pattern, mode := range m {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("chmod_map: bad pattern %q: %w", pattern, err)
+		}
+		if !octalMode.MatchString(mode) && !symbolicMode.MatchString(mode) {
+			return fmt.Errorf("chmod_map: bad mode %q for %q (want e.g. 0755 or u+x)", mode, pattern)
+		}
+	}
+	return nil
+}
+
+// chmodMatch reports whether file matches pattern. Patterns without a slash
+// match the file's base name, like .gitignore entries.
+func chmodMatch(pattern, file string) bool {
+	if !strings.Contains(pattern, "/") {
+		file = path.Base(file)
+	}
+	ok, _ := path.Match(pattern, file)
+	return ok
+}
+
+// applyChmodMap sets remote permissions on the synced files matched by the
+// remote's ChmodMap. Patterns are applied in sorted order, so when several
+// match the same file the last one wins.
+func applyChmodMap(ctx context.Context, remote Remote, files []string) error {
+	if len(remote.ChmodMap) == 0 {
+		return nil
+	}
+	if remote.Shell == "powershell" {
+		fmt.Fprintln(remote.stdout(), "==> Skipping chmod_map: not supported for powershell remotes.")
+		return nil
+	}
+
+	patterns := make([]string, 0, len(remote.ChmodMap))
+	for p := range remote.ChmodMap {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+	for _, pattern := range patterns {
+		var matched []string
+		for _, f := range files {
+			if chmodMatch(pattern, f) {
+				matched = append(matched, f)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		mode := remote.ChmodMap[pattern]
+		fmt.Fprintf(remote.stdout(), "==> chmod %s on %d file(s) matching %s\n", mode, len(matched), pattern)
+		cmdStr := fmt.Sprintf("cd %s && xargs -0 chmod %s --", shellQuotePOSIX(remote.Path), mode)
+		c := sshCommandContext(ctx, remote, target, cmdStr)
+		c.Stdin = strings.NewReader(strings.Join(matched, "\x00"))
+		c.Stdout = remote.stdout()
+		c.Stderr = remote.stderr()
+		if err := runRemoteCmd(ctx, remote, c); err != nil {
+			return fmt.Errorf("chmod %s on %s: %w", mode, pattern, err)
+		}
+	}
+	return nil
+}
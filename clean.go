@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// runClean implements "buildon clean": it deletes buildon's cached state
+// under ~/.cache/buildon, either entirely or for one remote's host. The
+// config file is never touched.
+func runClean(args []string) {
+	fs := flag.NewFlagSet("buildon clean", flag.ExitOnError)
+	remoteName := fs.String("remote", "", "only remove cached state for the remote `name`")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: buildon clean [--remote <name>]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	dir, err := cacheDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *remoteName != "" {
+		// The host is looked up as configured: cleaning shouldn't run
+		// remote_resolver or need the remote's key and ssh_config.
+		remote, ok := loadConfig(loadProject()).Remote[*remoteName]
+		if !ok {
+			log.Fatalf("no remote named %s", *remoteName)
+		}
+		if remote.RemoteResolver != "" {
+			log.Fatalf("remote %s: the host is only known once remote_resolver runs; use plain \"buildon clean\" to remove all cached state", *remoteName)
+		}
+		if remote.Host == "" {
+			log.Fatalf("remote %s has no host", *remoteName)
+		}
+		if dir, err = hostCacheDir(remote.Host); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("==> Nothing to clean.")
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if err := os.RemoveAll(path); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("removed %s\n", path)
+	}
+	if err := os.Remove(dir); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("==> Cleaned %s\n", dir)
+}
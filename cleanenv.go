@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cleanEnvKeepPS are the variables a Windows process can't do without;
+// --clean-env keeps them on PowerShell remotes along with Path.
+var cleanEnvKeepPS = []string{"Path", "SystemRoot", "ComSpec", "PATHEXT"}
+
+// cleanEnvPOSIX runs cmdStr under env -i, so it sees only PATH, the
+// variables named in keep (with their session values), and env.
+func cleanEnvPOSIX(keep []string, env map[string]string, cmdStr string) string {
+	parts := []string{"env", "-i", `PATH="$PATH"`}
+	for _, k := range keep {
+		parts = append(parts, fmt.Sprintf(`%s="$%s"`, k, k))
+	}
+	for _, k := range sortedKeys(env) {
+		parts = append(parts, k+"="+shellQuotePOSIX(env[k]))
+	}
+	return strings.Join(append(parts, "sh", "-c", shellQuotePOSIX(cmdStr)), " ")
+}
+
+// cleanEnvPS removes every environment variable of the PowerShell session
+// except cleanEnvKeepPS and keep, so the command and what it starts inherit
+// only those and the remote's env, which is set after this.
+func cleanEnvPS(keep []string) string {
+	names := make([]string, 0, len(cleanEnvKeepPS)+len(keep))
+	for _, k := range append(append([]string{}, cleanEnvKeepPS...), keep...) {
+		names = append(names, quotePS(k))
+	}
+	return fmt.Sprintf(
+		`Get-ChildItem Env: | Where-Object { @(%s) -notcontains $_.Name } | ForEach-Object { Remove-Item -Path ('Env:' + $_.Name) }; `,
+		strings.Join(names, ","),
+	)
+}
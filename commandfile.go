@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Command file directives. A line starting with one runs only depending on
+// how the last plain (undirected) command went.
+const (
+	directiveIfOK   = "@if-ok"
+	directiveIfFail = "@if-fail"
+)
+
+// commandLine is one command from a --command-file.
+type commandLine struct {
+	Directive string // "", directiveIfOK or directiveIfFail
+	Command   string
+	Line      int
+}
+
+// loadCommandFile reads a --command-file: one command per line, with blank
+// lines and lines starting with # ignored.
+func loadCommandFile(path string) ([]commandLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("--command-file: %w", err)
+	}
+	defer f.Close()
+
+	var lines []commandLine
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		cl := commandLine{Command: text, Line: n}
+		if strings.HasPrefix(text, "@") {
+			directive, rest, _ := strings.Cut(text, " ")
+			if directive != directiveIfOK && directive != directiveIfFail {
+				return nil, fmt.Errorf("%s:%d: unknown directive %s (want %s or %s)", path, n, directive, directiveIfOK, directiveIfFail)
+			}
+			if rest = strings.TrimSpace(rest); rest == "" {
+				return nil, fmt.Errorf("%s:%d: %s needs a command", path, n, directive)
+			}
+			cl.Directive, cl.Command = directive, rest
+		}
+		lines = append(lines, cl)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("--command-file: %w", err)
+	}
+	return lines, nil
+}
+
+// runCommandFile runs the commands of opts.CommandFile one after another.
+// Plain commands stop running once one of them has failed. @if-ok and
+// @if-fail commands look only at the last plain command before them, so
+// cleanup and diagnostics steps don't change what later directives see. The
+// run fails if any command it ran failed.
+func runCommandFile(ctx context.Context, remote Remote, opts Options, files []string) error {
+	lines, err := loadCommandFile(opts.CommandFile)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	lastOK, plainFailed := true, false
+	for _, cl := range lines {
+		var run bool
+		switch cl.Directive {
+		case directiveIfOK:
+			run = lastOK
+		case directiveIfFail:
+			run = !lastOK
+		default:
+			run = !plainFailed
+		}
+		if !run {
+			fmt.Fprintf(remote.stdout(), "==> Skipping line %d: %s\n", cl.Line, cl.Command)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := runOneCommand(ctx, remote, opts, []string{cl.Command}, files)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s:%d: %w", opts.CommandFile, cl.Line, err)
+		}
+		if cl.Directive == "" {
+			lastOK = err == nil
+			plainFailed = plainFailed || err != nil
+		}
+	}
+	return firstErr
+}
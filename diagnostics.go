@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// diagnosticLines caps how much of each failure diagnostic's output is shown.
+const diagnosticLines = 100
+
+// runFailureDiagnostics runs the remote's FailureDiagnostics commands in the
+// remote path after its command failed, printing each one's output (stdout
+// and stderr, at most diagnosticLines lines) under a header. All of them run
+// in one ssh session; a diagnostic that fails doesn't stop the others.
+func runFailureDiagnostics(ctx context.Context, remote Remote) {
+	if len(remote.FailureDiagnostics) == 0 {
+		return
+	}
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+
+	var sshArgs []string
+	if remote.Shell == "powershell" {
+		parts := []string{fmt.Sprintf("Set-Location -Path %s", quotePS(remote.Path))}
+		for _, d := range remote.FailureDiagnostics {
+			parts = append(parts, fmt.Sprintf(
+				"Write-Output %s; & { %s } 2>&1 | Select-Object -First %d",
+				quotePS("==> Diagnostic: "+d), d, diagnosticLines,
+			))
+		}
+		parts = append(parts, "Write-Output '==> End of diagnostics'")
+		sshArgs = []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", strings.Join(parts, "; ")}
+	} else {
+		parts := []string{fmt.Sprintf("cd %s", shellQuotePOSIX(remote.Path))}
+		for _, d := range remote.FailureDiagnostics {
+			parts = append(parts, fmt.Sprintf(
+				"echo %s; (\n%s\n) 2>&1 </dev/null | head -n %d",
+				shellQuotePOSIX("==> Diagnostic: "+d), d, diagnosticLines,
+			))
+		}
+		parts = append(parts, "echo '==> End of diagnostics'")
+		sshArgs = []string{target, strings.Join(parts, "; ")}
+	}
+
+	fmt.Fprintf(remote.stderr(), "==> Command failed; running %d failure diagnostic(s) on %s\n", len(remote.FailureDiagnostics), target)
+	c := sshCommandContext(ctx, remote, sshArgs...)
+	c.Stdout = remote.stderr()
+	c.Stderr = remote.stderr()
+	if err := runRemoteCmd(ctx, remote, c); err != nil {
+		fmt.Fprintf(remote.stderr(), "warning: failure diagnostics: %v\n", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pelletier/go-toml"
+)
+
+// recordSources notes the file and line each remote setting was read from,
+// so --explain can show where a resolved value came from.
+func recordSources(cfg *Config, tree *toml.Tree, path string) {
+	for name, remote := range cfg.Remote {
+		sub, ok := tree.GetPath([]string{"remote", name}).(*toml.Tree)
+		if !ok {
+			continue
+		}
+		if remote.sources == nil {
+			remote.sources = map[string]string{}
+		}
+		for _, key := range sub.Keys() {
+			pos := tree.GetPositionPath([]string{"remote", name, key})
+			remote.sources[strings.ToLower(key)] = fmt.Sprintf("%s:%d", path, pos.Line)
+		}
+		cfg.Remote[name] = remote
+	}
+}
+
+// setSource records that a remote setting was overridden from outside the
+// config file.
+func (r *Remote) setSource(key, source string) {
+	if r.sources == nil {
+		r.sources = map[string]string{}
+	}
+	r.sources[key] = source
+}
+
+// remoteKey returns the config key a Remote field is read from.
+func remoteKey(f reflect.StructField) string {
+	if tag, _, _ := strings.Cut(f.Tag.Get("toml"), ","); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// explainRemote prints every setting of the resolved remote alongside the
+// place it came from: a config file line, an env var, a flag, or the default.
+func explainRemote(name string, remote Remote, configPath string) {
+	configSource := "default"
+	if os.Getenv("BUILDON_CONFIG") != "" {
+		configSource = "env BUILDON_CONFIG"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+	fmt.Fprintf(w, "config\t%s\t%s\n", configPath, configSource)
+
+	v := reflect.ValueOf(remote)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		key := remoteKey(f)
+		source, ok := remote.sources[key]
+		if !ok {
+			source = "default"
+		}
+		fmt.Fprintf(w, "remote.%s.%s\t%v\t%s\n", name, key, v.Field(i).Interface(), source)
+	}
+	w.Flush()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// extraSource is a local directory synced into a subdirectory of the remote
+// path by --extra-source, in addition to the git-selected files.
+type extraSource struct {
+	Local  string
+	Subdir string
+}
+
+// parseExtraSource parses "<localdir>:<remotesubdir>". The last colon splits
+// the two so Windows drive letters keep working.
+func parseExtraSource(s string) (extraSource, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return extraSource{}, fmt.Errorf("--extra-source %q: want <localdir>:<remotesubdir>", s)
+	}
+	src := extraSource{Local: s[:i], Subdir: path.Clean(filepath.ToSlash(s[i+1:]))}
+	if path.IsAbs(src.Subdir) || src.Subdir == ".." || strings.HasPrefix(src.Subdir, "../") {
+		return extraSource{}, fmt.Errorf("--extra-source %q: subdir must stay inside the remote path", s)
+	}
+	info, err := os.Stat(src.Local)
+	if err != nil {
+		return extraSource{}, fmt.Errorf("--extra-source %q: %w", s, err)
+	}
+	if !info.IsDir() {
+		return extraSource{}, fmt.Errorf("--extra-source %q: %s is not a directory", s, src.Local)
+	}
+	return src, nil
+}
+
+// remoteFiles lists the remote-relative paths the source will write.
+func (src extraSource) remoteFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(src.Local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src.Local, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, path.Join(src.Subdir, filepath.ToSlash(rel)))
+		return nil
+	})
+	return files, err
+}
+
+// syncExtraSources runs one rsync pass per --extra-source after the main
+// sync, reusing its transport settings. Unless opts.AllowOverlap is set, a
+// pass that would overwrite a file written by an earlier pass is an error.
+func syncExtraSources(ctx context.Context, remote Remote, opts Options, synced []string) error {
+	if len(opts.ExtraSources) == 0 {
+		return nil
+	}
+
+	var sources []extraSource
+	for _, s := range opts.ExtraSources {
+		src, err := parseExtraSource(s)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+	}
+
+	written := map[string]string{}
+	for _, f := range synced {
+		written[f] = "the main sync"
+	}
+	for _, src := range sources {
+		files, err := src.remoteFiles()
+		if err != nil {
+			return fmt.Errorf("--extra-source %s: %w", src.Local, err)
+		}
+		for _, f := range files {
+			if by, ok := written[f]; ok && !opts.AllowOverlap {
+				return fmt.Errorf("--extra-source %s would overwrite %s from %s (pass --allow-overlap if that is intended)", src.Local, f, by)
+			}
+			written[f] = src.Local
+		}
+	}
+
+	if !opts.DryRun {
+		if err := mkdirRemote(ctx, remote, sources); err != nil {
+			return err
+		}
+	}
+
+	for _, src := range sources {
+		dest := fmt.Sprintf("%s@%s:%s/%s/", remote.User, remote.Host, strings.TrimSuffix(remote.Path, "/"), src.Subdir)
+		args := append(rsyncTransportArgs(remote, opts), strings.TrimSuffix(src.Local, string(filepath.Separator))+"/", dest)
+
+		fmt.Fprintf(remote.stdout(), "==> Syncing %s into %s...\n", src.Local, src.Subdir)
+		cmd := commandContext(ctx, "rsync", args...)
+		cmd.Stdout = remote.stdout()
+		cmd.Stderr = remote.stderr()
+		if err := rsyncError(remote.stderr(), runCmd(cmd)); err != nil {
+			return fmt.Errorf("sync %s: %w", src.Local, err)
+		}
+	}
+	return nil
+}
+
+// mkdirRemote creates each source's subdir, since rsync only creates the
+// last component of a destination.
+func mkdirRemote(ctx context.Context, remote Remote, sources []extraSource) error {
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+
+	var sshArgs []string
+	if remote.Shell == "powershell" {
+		ps := fmt.Sprintf(`Set-Location -Path %s;`, quotePS(remote.Path))
+		for _, src := range sources {
+			ps += fmt.Sprintf(` New-Item -ItemType Directory -Force -Path %s *> $null;`, quotePS(src.Subdir))
+		}
+		sshArgs = []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
+	} else {
+		dirs := make([]string, len(sources))
+		for i, src := range sources {
+			dirs[i] = shellQuotePOSIX(src.Subdir)
+		}
+		cmdStr := fmt.Sprintf("%s && cd %s && mkdir -p %s",
+			mkdirPOSIX(remote), shellQuotePOSIX(remote.Path), strings.Join(dirs, " "))
+		sshArgs = []string{target, cmdStr}
+	}
+
+	c := sshCommandContext(ctx, remote, sshArgs...)
+	c.Stderr = remote.stderr()
+	if err := runCmd(c); err != nil {
+		return errors.New("failed to create --extra-source directories on the remote")
+	}
+	return nil
+}
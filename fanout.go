@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// remoteResult is the outcome of syncing and running on one remote in a
+// multi-remote run.
+type remoteResult struct {
+	Name     string
+	Err      error
+	Skipped  bool
+	Stopped  bool // cancelled by --fail-fast after another remote failed
+	Log      string
+	Duration time.Duration
+}
+
+// fanout runs one command across several remotes.
+type fanout struct {
+	ctx     context.Context
+	cancel  context.CancelFunc // stops every remote, for --fail-fast
+	opts    Options
+	command []string
+	results []remoteResult
+	tui     *tui // live dashboard for --tui, or nil
+
+	// syncSlots limits how many remotes sync at once under
+	// --serial-command when --jobs is set, or is nil.
+	syncSlots chan struct{}
+
+	mu     sync.Mutex // guards failed and progress lines
+	failed bool
+	outMu  sync.Mutex // shared by the prefix writers
+}
+
+// runFanout syncs and runs command on each remote. Remotes run in parallel,
+// at most opts.Jobs at a time when that is set; after a failure no more of
+// them start, and none that are still syncing go on to run the command,
+// unless opts.KeepGoing is set. Without opts.Jobs every remote has started
+// by then, so only the command skip applies. With opts.FailFast the ones
+// still running are stopped too. It prints a summary and reports whether
+// every remote succeeded.
+func runFanout(ctx context.Context, remotes []Remote, opts Options, command []string) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f := &fanout{ctx: ctx, cancel: cancel, opts: opts, command: command, results: make([]remoteResult, len(remotes))}
+	if opts.LogDir != "" {
+		if err := os.MkdirAll(opts.LogDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "==> --log-dir: %v\n", err)
+			return false
+		}
+	}
+
+	if opts.TUI {
+		f.tui = newTUI(remotes)
+	}
+
+	switch {
+	case opts.SerialCommand || anySerialized(remotes):
+		f.runSerializedCommands(remotes)
+	case opts.Jobs == 1:
+		f.runSequential(remotes)
+	default:
+		f.runParallel(remotes)
+	}
+
+	if f.tui != nil {
+		f.tui.Stop()
+		f.printFailedOutput()
+	}
+	printSummary(f.results)
+	for _, r := range f.results {
+		if r.Err != nil || r.Skipped || r.Stopped {
+			return false
+		}
+	}
+	return true
+}
+
+func anySerialized(remotes []Remote) bool {
+	for _, r := range remotes {
+		if r.SerializeCommand {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fanout) runSequential(remotes []Remote) {
+	for i, remote := range remotes {
+		f.results[i].Name = remote.name
+		if f.shouldSkip() {
+			f.results[i].Skipped = true
+			f.progress(i, "skipped")
+			continue
+		}
+
+		remote, closeOutput, err := f.attachOutput(i, remote, false)
+		if err != nil {
+			f.fail(i, remote, err)
+			continue
+		}
+		if f.opts.LogDir == "" && f.tui == nil {
+			fmt.Printf("==> [%s] %s@%s\n", remote.name, remote.User, remote.Host)
+		}
+		f.runOne(i, remote, nil)
+		closeOutput()
+	}
+}
+
+// runParallel runs every remote at once, or opts.Jobs at a time, with
+// output prefixed by remote name. Remotes waiting for a slot are skipped if
+// a failure means the rest shouldn't start.
+func (f *fanout) runParallel(remotes []Remote) {
+	jobs := f.opts.Jobs
+	if jobs <= 0 || jobs > len(remotes) {
+		jobs = len(remotes)
+	}
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		f.results[i].Name = remote.name
+		if jobs < len(remotes) {
+			f.progress(i, "waiting")
+		}
+
+		wg.Add(1)
+		go func(i int, remote Remote) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if f.shouldSkip() {
+				f.results[i].Skipped = true
+				f.progress(i, "skipped")
+				return
+			}
+
+			remote, closeOutput, err := f.attachOutput(i, remote, true)
+			if err != nil {
+				f.fail(i, remote, err)
+				return
+			}
+			defer closeOutput()
+			f.runOne(i, remote, nil)
+		}(i, remote)
+	}
+	wg.Wait()
+}
+
+// runSerializedCommands syncs every remote in parallel, or opts.Jobs at a
+// time. Commands of serialized remotes (all of them with --serial-command)
+// then take turns in the order the remotes were given, each waiting for the
+// previous one to finish; other remotes run theirs as soon as their sync is
+// done. A remote gives up its sync slot before waiting for its turn, so the
+// limit can't hold back an earlier remote's command.
+func (f *fanout) runSerializedCommands(remotes []Remote) {
+	if jobs := f.opts.Jobs; jobs > 0 && jobs < len(remotes) {
+		f.syncSlots = make(chan struct{}, jobs)
+	}
+	var prevTurn chan struct{}
+	var wg sync.WaitGroup
+	for i, remote := range remotes {
+		f.results[i].Name = remote.name
+		if f.syncSlots != nil {
+			f.progress(i, "waiting")
+		}
+
+		var waitTurn, done chan struct{}
+		if f.opts.SerialCommand || remote.SerializeCommand {
+			waitTurn, done = prevTurn, make(chan struct{})
+			prevTurn = done
+		}
+
+		wg.Add(1)
+		go func(i int, remote Remote) {
+			defer wg.Done()
+			if done != nil {
+				defer close(done)
+			}
+
+			remote, closeOutput, err := f.attachOutput(i, remote, true)
+			if err != nil {
+				f.fail(i, remote, err)
+				return
+			}
+			defer closeOutput()
+			f.runOne(i, remote, waitTurn)
+		}(i, remote)
+	}
+	wg.Wait()
+}
+
+// runOne syncs remote, holding one of f.syncSlots meanwhile if they are
+// set, waits for waitTurn if it is non-nil, then runs the command unless an
+// earlier failure means the rest should be skipped.
+func (f *fanout) runOne(i int, remote Remote, waitTurn <-chan struct{}) {
+	start := time.Now()
+	defer func() { f.results[i].Duration = time.Since(start) }()
+
+	if f.syncSlots != nil {
+		f.syncSlots <- struct{}{}
+		if f.shouldSkip() {
+			<-f.syncSlots
+			f.results[i].Skipped = true
+			f.progress(i, "skipped")
+			return
+		}
+	}
+	f.progress(i, "syncing")
+	files, err := syncRemote(f.ctx, remote, f.opts)
+	if f.syncSlots != nil {
+		<-f.syncSlots
+	}
+	if err != nil {
+		f.fail(i, remote, err)
+		return
+	}
+
+	if waitTurn != nil {
+		<-waitTurn
+	}
+	if f.shouldSkip() {
+		f.results[i].Skipped = true
+		f.progress(i, "skipped")
+		return
+	}
+
+	f.progress(i, "running command")
+	if err := runSynced(f.ctx, remote, f.opts, f.command, files); err != nil {
+		f.fail(i, remote, err)
+		return
+	}
+	f.progress(i, "ok")
+}
+
+// attachOutput points the remote's output at its log file under --log-dir
+// and the --tui dashboard, or at prefixed terminal output when remotes run
+// in parallel. The returned func flushes and closes it.
+func (f *fanout) attachOutput(i int, remote Remote, parallel bool) (Remote, func(), error) {
+	var w io.Writer
+	closeOutput := func() {}
+	if f.opts.LogDir != "" {
+		path := filepath.Join(f.opts.LogDir, remote.name+".log")
+		file, err := os.Create(path)
+		if err != nil {
+			return remote, nil, fmt.Errorf("--log-dir: %w", err)
+		}
+		f.results[i].Log = path
+		w, closeOutput = file, func() { file.Close() }
+	}
+	if f.tui != nil {
+		if w != nil {
+			w = io.MultiWriter(w, f.tui.writer(i))
+		} else {
+			w = f.tui.writer(i)
+		}
+	}
+	if w != nil {
+		remote.out, remote.errOut, remote.detached = w, w, true
+		return remote, closeOutput, nil
+	}
+	if !parallel {
+		return remote, func() {}, nil
+	}
+
+	out := newPrefixWriter(os.Stdout, &f.outMu, remote.name)
+	errOut := newPrefixWriter(os.Stderr, &f.outMu, remote.name)
+	remote.out, remote.errOut, remote.detached = out, errOut, true
+	return remote, func() {
+		out.Flush()
+		errOut.Flush()
+	}, nil
+}
+
+// progress updates a remote's row on the --tui dashboard, or prints a
+// one-line status when its full output goes to a log file, so the terminal
+// still shows how the run is going.
+func (f *fanout) progress(i int, status string) {
+	if f.tui != nil {
+		f.tui.setStatus(i, status)
+		return
+	}
+	if f.opts.LogDir == "" {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Printf("==> [%s] %s\n", f.results[i].Name, status)
+}
+
+func (f *fanout) fail(i int, remote Remote, err error) {
+	f.mu.Lock()
+	if f.failed && f.opts.FailFast && f.ctx.Err() != nil {
+		// Stopped because another remote failed first.
+		f.mu.Unlock()
+		f.results[i].Stopped = true
+		f.progress(i, "stopped")
+		return
+	}
+	f.results[i].Err = err
+	f.failed = true
+	if f.opts.FailFast {
+		f.cancel()
+	}
+	f.mu.Unlock()
+
+	if f.tui != nil {
+		fmt.Fprintf(remote.stderr(), "==> failed: %v\n", err)
+		f.tui.setStatus(i, "FAILED")
+		return
+	}
+
+	if log := f.results[i].Log; log != "" {
+		fmt.Fprintf(remote.stderr(), "==> failed: %v\n", err)
+		f.mu.Lock()
+		fmt.Fprintf(os.Stderr, "==> [%s] FAILED: %v (see %s)\n", remote.name, err, log)
+		f.mu.Unlock()
+		return
+	}
+	if remote.errOut != nil {
+		fmt.Fprintf(remote.stderr(), "==> failed: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "==> [%s] failed: %v\n", remote.name, err)
+}
+
+// printFailedOutput shows the last lines a failed remote printed, which the
+// --tui dashboard kept off the terminal during the run.
+func (f *fanout) printFailedOutput() {
+	for i, r := range f.results {
+		if r.Err == nil {
+			continue
+		}
+		if r.Log != "" {
+			fmt.Fprintf(os.Stderr, "==> [%s] failed; full output in %s\n", r.Name, r.Log)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "==> [%s] last output:\n", r.Name)
+		for _, line := range f.tui.tail(i) {
+			fmt.Fprintf(os.Stderr, "  %s\n", line)
+		}
+	}
+}
+
+// shouldSkip reports whether remotes that haven't started should be left
+// out: after a failure unless --keep-going, and always once interrupted.
+func (f *fanout) shouldSkip() bool {
+	if f.ctx.Err() != nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failed && !f.opts.KeepGoing
+}
+
+// prefixWriter writes each complete line to w prefixed with "[name] ".
+// Writers sharing mu never interleave within a line.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, mu *sync.Mutex, name string) *prefixWriter {
+	return &prefixWriter{w: w, mu: mu, prefix: []byte("[" + name + "] ")}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.writeLine(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes out a trailing line that has no newline yet.
+func (p *prefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	p.w.Write(append(append([]byte{}, p.prefix...), line...))
+}
+
+func printSummary(results []remoteResult) {
+	fmt.Println("==> Summary:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		status, took, detail := "ok", r.Duration.Round(100*time.Millisecond).String(), ""
+		switch {
+		case r.Skipped:
+			status, took = "skipped", ""
+		case r.Stopped:
+			status = "stopped"
+		case r.Err != nil:
+			status, detail = "FAILED", r.Err.Error()
+		}
+		if r.Log != "" {
+			if detail != "" {
+				detail += "\t"
+			}
+			detail += r.Log
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", r.Name, status, took, detail)
+	}
+	w.Flush()
+}
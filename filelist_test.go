@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// benchRepo creates a git repository of n small files and changes into it.
+func benchRepo(b *testing.B, n int) {
+	b.Helper()
+	dir := b.TempDir()
+	for i := 0; i < n; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%03d", i%100))
+		if err := os.MkdirAll(sub, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("f%d.txt", i)), []byte("x"), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	git := func(args ...string) {
+		c := exec.Command("git", args...)
+		c.Dir = dir
+		if out, err := c.CombinedOutput(); err != nil {
+			b.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("add", ".")
+	b.Chdir(dir)
+}
+
+// consumer stands in for rsync reading --files-from=-: like rsync, which
+// only reads the list once ssh has connected, it spends a moment starting up
+// before it drains its stdin.
+func consumer(b *testing.B) (*exec.Cmd, io.WriteCloser) {
+	b.Helper()
+	c := exec.Command("sh", "-c", "sleep 0.2; cat >/dev/null")
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		b.Fatal(err)
+	}
+	return c, stdin
+}
+
+// BenchmarkFileListTwoPhase is the old approach: select every file, then
+// start the consumer and hand it the list.
+func BenchmarkFileListTwoPhase(b *testing.B) {
+	benchRepo(b, 20000)
+	sel := selection{}
+	for i := 0; i < b.N; i++ {
+		files, _, err := selectFiles(sel)
+		if err != nil {
+			b.Fatal(err)
+		}
+		c, stdin := consumer(b)
+		w := bufio.NewWriterSize(stdin, 1<<20)
+		for _, f := range files {
+			w.WriteString(f + "\n")
+		}
+		w.Flush()
+		stdin.Close()
+		c.Wait()
+	}
+}
+
+// BenchmarkFileListStreamed is what rsyncToRemote does: the consumer runs
+// while git is still listing files.
+func BenchmarkFileListStreamed(b *testing.B) {
+	benchRepo(b, 20000)
+	sel := selection{}
+	for i := 0; i < b.N; i++ {
+		c, stdin := consumer(b)
+		w := bufio.NewWriterSize(stdin, 1<<20)
+		err := streamFilesToSync(sel, func(f string, _ bool) error {
+			_, err := w.WriteString(f + "\n")
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.Flush()
+		stdin.Close()
+		c.Wait()
+	}
+}
+
+// fileList200k is a file list the size of a large monorepo's.
+func fileList200k() []string {
+	files := make([]string, 200000)
+	for i := range files {
+		files[i] = fmt.Sprintf("src/module%03d/pkg/file_%06d.go", i%500, i)
+	}
+	return files
+}
+
+// BenchmarkFileListUnbuffered writes the --emit-rsync list straight to the
+// temp file, one write per entry, as before.
+func BenchmarkFileListUnbuffered(b *testing.B) {
+	files := fileList200k()
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmp, err := os.CreateTemp(dir, "list-*")
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, f := range files {
+			tmp.WriteString(f + "\n")
+		}
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+}
+
+// BenchmarkFileListBuffered writes it through the 1MB bufio.Writer emitRsync
+// uses.
+func BenchmarkFileListBuffered(b *testing.B) {
+	files := fileList200k()
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmp, err := os.CreateTemp(dir, "list-*")
+		if err != nil {
+			b.Fatal(err)
+		}
+		w := bufio.NewWriterSize(tmp, 1<<20)
+		for _, f := range files {
+			w.WriteString(f + "\n")
+		}
+		if err := w.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+}
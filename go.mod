@@ -2,4 +2,13 @@ module github.com/littledivy/buildon
 
 go 1.24.2
 
-require github.com/pelletier/go-toml v1.9.5
+require (
+	github.com/pelletier/go-toml v1.9.5
+	github.com/pkg/sftp v1.13.10
+	golang.org/x/crypto v0.48.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.41.0 // indirect
+)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Group names a set of remotes so a fanout can be invoked as
+// "buildon @<name>". Members are remote names or other groups as "@name".
+type Group struct {
+	Members []string
+}
+
+// isGroupRef reports whether a remote name refers to a group.
+func isGroupRef(name string) bool {
+	return strings.HasPrefix(name, "@")
+}
+
+// expandRemoteNames turns a comma-separated list of remotes and @groups into
+// remote names, in order and without duplicates. It fails on unknown
+// remotes or groups and on groups that include themselves.
+func expandRemoteNames(cfg Config, list string) ([]string, error) {
+	var names []string
+	seen := map[string]bool{}
+	var expand func(name string, path []string) error
+	expand = func(name string, path []string) error {
+		if !isGroupRef(name) {
+			if _, ok := cfg.Remote[name]; !ok {
+				if len(path) > 0 {
+					return fmt.Errorf("group %s: no remote named %s", path[len(path)-1], name)
+				}
+				return fmt.Errorf("no remote named %s", name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			return nil
+		}
+
+		group := strings.TrimPrefix(name, "@")
+		for i, p := range path {
+			if p == group {
+				return fmt.Errorf("group cycle: @%s", strings.Join(append(path[i:], group), " -> @"))
+			}
+		}
+		g, ok := cfg.Group[group]
+		if !ok {
+			return fmt.Errorf("no group named %s", group)
+		}
+		if len(g.Members) == 0 {
+			return fmt.Errorf("group %s has no members", group)
+		}
+		for _, m := range g.Members {
+			if err := expand(strings.TrimSpace(m), append(path, group)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		if err := expand(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// localCommand builds the local shell invocation for --local, run from the
+// repository root, or the current directory outside a repository. Like a
+// remote command, its words are joined and handed to a shell.
+func localCommand(ctx context.Context, command []string) *exec.Cmd {
+	dir := "."
+	if root, err := outputCmd(exec.Command("git", "rev-parse", "--show-toplevel")); err == nil {
+		dir = strings.TrimSpace(string(root))
+	}
+
+	cmdStr := strings.Join(command, " ")
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = commandContext(ctx, "cmd", "/C", cmdStr)
+	} else {
+		c = commandContext(ctx, "sh", "-c", cmdStr)
+	}
+	c.Dir = dir
+	return c
+}
+
+// runLocalCommand runs command locally for --local, after the remote sync.
+func runLocalCommand(ctx context.Context, remote Remote, opts Options, command []string) error {
+	c := localCommand(ctx, command)
+	if opts.DryRun {
+		fmt.Fprintf(remote.stdout(), "==> Would run locally in %s: %s\n", c.Dir, strings.Join(command, " "))
+		return nil
+	}
+
+	fmt.Fprintf(remote.stdout(), "==> Running locally: %s\n", strings.Join(command, " "))
+	c.Stdin = remote.stdin()
+	c.Stdout = remote.stdout()
+	c.Stderr = remote.stderr()
+	return runCmd(c)
+}
@@ -1,155 +1,586 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pelletier/go-toml"
 )
 
 type Remote struct {
-	Host  string
-	User  string
-	Shell string
-	Path  string
+	Host      string
+	User      string
+	Shell     string
+	Path      string
+	SSHConfig string `toml:"ssh_config"`
+	Bootstrap string
+	ChmodMap  map[string]string `toml:"chmod_map"`
+	Env       map[string]string
+
+	// RemoteResolver is a local command printing the host (or user@host)
+	// to connect to, for targets that only exist once provisioned.
+	RemoteResolver string `toml:"remote_resolver"`
+
+	// RemoteTmp is where buildon keeps transient remote state. It defaults
+	// to a hidden directory next to Path.
+	RemoteTmp string `toml:"remote_tmp"`
+
+	// SerializeCommand makes this remote's command wait its turn in
+	// multi-remote runs, while its sync still runs in parallel.
+	SerializeCommand bool `toml:"serialize_command"`
+
+	// UntrackedPolicy is what to do about untracked files that would be
+	// synced: "include" (the default), "warn", or "error" to refuse.
+	UntrackedPolicy string `toml:"untracked_policy"`
+
+	// FailureDiagnostics are remote commands whose output is shown when
+	// the main command fails, e.g. "df -h" or "tail -50 build.log".
+	FailureDiagnostics []string `toml:"failure_diagnostics"`
+
+	// GitRequired makes syncing outside a git repository an error. When
+	// false, buildon syncs every file in the directory instead.
+	GitRequired bool `toml:"git_required" default:"true"`
+
+	// PreSyncRemote is a command run on the remote before every sync; the
+	// sync is aborted if it exits nonzero.
+	PreSyncRemote string `toml:"pre_sync_remote"`
+
+	// FilterFile is an rsync filter rules file merged into the sync
+	// (rsync --filter="merge FILE").
+	FilterFile string `toml:"filter_file"`
+
+	// Port, IdentityFile and SSHOptions (each "Key=Value", passed as -o)
+	// are added to every ssh connection to the remote, rsync's included.
+	Port         int
+	IdentityFile string   `toml:"identity_file"`
+	SSHOptions   []string `toml:"ssh_options"`
+
+	// CompressChoice picks rsync's compression algorithm, e.g. "zstd"
+	// (rsync --compress-choice, rsync 3.2.0 and later).
+	CompressChoice string `toml:"compress_choice"`
+
+	// PathMode is the mode Path is created with, e.g. "0775" for a shared
+	// build directory. It is ignored on PowerShell remotes.
+	PathMode string `toml:"path_mode"`
+
+	// Artifacts are paths or globs in Path copied back after a command
+	// succeeds, into ArtifactsDir (default: the current directory).
+	Artifacts    []string
+	ArtifactsDir string `toml:"artifacts_dir"`
+
+	// PostRunRemote is run in Path after the command succeeds.
+	PostRunRemote string `toml:"post_run_remote"`
+
+	// Transport is "exec" (the default) to sync with rsync and run commands
+	// with ssh, or "native" to do both over buildon's own ssh connection.
+	Transport string
+
+	name      string
+	sources   map[string]string
+	ipFamily  string   // "4" or "6" to force ssh's address family
+	linkDest  string   // rsync --link-dest, relative to Path
+	pidFile   string   // in remote_tmp; records the command's process group, for --timeout and --watch-restart
+	tty       bool     // allocate a pty for commands, not just shells
+	pathKnown bool     // Path was recently seen to exist; see remotePathKnown
+	cleanEnv  bool     // run commands with only PATH, keepEnv and Env set
+	keepEnv   []string // session variables --clean-env keeps
+	syncOnly  []string // sync just these paths, for --watch's incremental syncs
+
+	// sharedArtifacts is set when ArtifactsDir is --artifacts-dir or the
+	// default rather than the remote's own artifacts_dir.
+	sharedArtifacts bool
+
+	// events gets a change event for each file runWatch's syncs send, with
+	// --watch-events.
+	events *eventLog
+
+	// From buildon.toml: files kept out of the sync, and files added to it.
+	excludes, extraPaths []string
+
+	// Output of everything run for this remote; nil means the process's
+	// own stdout/stderr. detached runs without the terminal's stdin.
+	out, errOut io.Writer
+	detached    bool
+}
+
+func (r Remote) stdout() io.Writer {
+	if r.out != nil {
+		return r.out
+	}
+	return os.Stdout
+}
+
+func (r Remote) stderr() io.Writer {
+	if r.errOut != nil {
+		return r.errOut
+	}
+	return os.Stderr
+}
+
+func (r Remote) stdin() io.Reader {
+	if r.detached {
+		return nil
+	}
+	return os.Stdin
 }
 
 type Config struct {
-	Remote map[string]Remote
+	Remote  map[string]Remote
+	Profile map[string]Profile
+	Group   map[string]Group
+
+	project Project
 }
 
-func loadConfig() Config {
+// configPath returns the config file location: $BUILDON_CONFIG when set,
+// otherwise ~/.config/buildon/config.toml. The file need not exist.
+func configPath() (string, error) {
+	if p := os.Getenv("BUILDON_CONFIG"); p != "" {
+		return p, nil
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
-		log.Fatalf("failed to get home dir: %v", err)
+		return "", fmt.Errorf("failed to get home dir: %w", err)
 	}
+	return filepath.Join(home, ".config", "buildon", "config.toml"), nil
+}
 
-	configPath := filepath.Join(home, ".config", "buildon", "config.toml")
+// loadConfig reads the global config with the project's buildon.toml merged
+// over it. The global config may be missing when the project has one.
+func loadConfig(proj Project) Config {
+	configPath, err := configPath()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) && proj.path != "" {
+		data, err = nil, nil
+	}
 	if err != nil {
 		log.Fatalf("failed to read config at %s: %v", configPath, err)
 	}
 
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		log.Fatalf("failed to parse config: %v", err)
+	}
+	mergeProject(tree, proj)
 	var cfg Config
-	if err := toml.Unmarshal(data, &cfg); err != nil {
+	if err := tree.Unmarshal(&cfg); err != nil {
 		log.Fatalf("failed to parse config: %v", err)
 	}
+	recordSources(&cfg, tree, configPath)
+	if proj.tree != nil {
+		recordSources(&cfg, proj.tree, proj.path)
+	}
+	cfg.project = proj
 	return cfg
 }
+
+// expandHome replaces a leading "~/" in path with the user's home directory.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home dir: %w", err)
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
+
 func hasCmd(name string) bool {
 	_, err := exec.LookPath(name)
 	return err == nil
 }
 
+// insideGitRepo reports whether the current directory is in a git work
+// tree, without letting git complain on stderr when it isn't.
+func insideGitRepo(r CommandRunner) bool {
+	c := exec.Command("git", "rev-parse", "--is-inside-work-tree")
+	if err := r.Start(c); err != nil {
+		return false
+	}
+	return r.Wait(c) == nil
+}
+
 func gitOutput(args ...string) ([]byte, error) {
 	cmd := exec.Command("git", args...)
 	cmd.Stderr = os.Stderr
-	return cmd.Output()
+	return outputCmd(cmd)
 }
 
-func splitNullBytes(b []byte) []string {
-	parts := strings.Split(string(b), "\x00")
-	var out []string
-	for _, p := range parts {
-		if p == "" {
-			continue
-		}
-		out = append(out, p)
+// scanNull is a bufio.SplitFunc for NUL-terminated records such as the
+// output of git ls-files -z.
+func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
 	}
-	return out
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
 }
 
-func filesToSync() ([]string, error) {
-	if _, err := gitOutput("rev-parse", "--is-inside-work-tree"); err != nil {
-		return nil, errors.New("not a git repository (run inside your repo)")
+// gitStream runs git through r and calls emit for every NUL-separated path
+// it prints, as it prints them.
+func gitStream(r CommandRunner, emit func(string) error, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := r.Start(cmd); err != nil {
+		return err
 	}
 
-	trackedRaw, err := gitOutput("ls-files", "-z")
-	if err != nil {
-		return nil, fmt.Errorf("git ls-files failed: %w", err)
+	sc := bufio.NewScanner(out)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	sc.Split(scanNull)
+	for sc.Scan() {
+		if sc.Text() == "" {
+			continue
+		}
+		if err := emit(sc.Text()); err != nil {
+			cmd.Process.Kill()
+			r.Wait(cmd)
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		cmd.Process.Kill()
+		r.Wait(cmd)
+		return err
 	}
+	return r.Wait(cmd)
+}
 
-	untrackedRaw, err := gitOutput("ls-files", "-z", "--others", "--exclude-standard")
-	if err != nil {
-		return nil, fmt.Errorf("git ls-files --others failed: %w", err)
+// streamFilesToSync calls emit for each tracked and untracked-but-not-ignored
+// file that exists on disk, as soon as git reports it, along with whether it
+// came from the untracked pass. Each path is emitted once. When pathspecs are
+// given, git restricts both passes to matching paths. A --from-manifest list
+// replaces git selection entirely. Without git (--no-git,
+// or git_required = false outside a repository) every file is emitted.
+// buildon.toml's exclude and include are applied on top of all of these.
+func streamFilesToSync(sel selection, emit func(f string, untracked bool) error) error {
+	if len(sel.excludes) > 0 || len(sel.extra) > 0 {
+		return projectFiles(sel, emit)
+	}
+	if sel.paths != nil {
+		return changedPathFiles(sel, emit)
 	}
+	if sel.manifest != "" {
+		return manifestFiles(sel, emit)
+	}
+	if sel.noGit {
+		return walkFiles(sel, emit)
+	}
+	if !insideGitRepo(sel.gitRunner()) {
+		if sel.gitOptional {
+			return walkFiles(sel, emit)
+		}
+		return errors.New("not a git repository (run inside your repo, or set git_required = false)")
+	}
+	pathspecs := sel.pathspecs
 
 	seen := map[string]struct{}{}
-	var all []string
-	for _, f := range splitNullBytes(trackedRaw) {
-		if _, ok := seen[f]; !ok {
-			seen[f] = struct{}{}
-			all = append(all, f)
+	visit := func(untracked bool) func(string) error {
+		from := "tracked"
+		if untracked {
+			from = "untracked"
 		}
-	}
-	for _, f := range splitNullBytes(untrackedRaw) {
-		if _, ok := seen[f]; !ok {
+		return func(f string) error {
+			if _, ok := seen[f]; ok {
+				sel.trace(from, "skip: already listed", f)
+				return nil
+			}
 			seen[f] = struct{}{}
-			all = append(all, f)
+			if _, err := os.Stat(f); err != nil {
+				sel.trace(from, "skip: not on disk", f)
+				return nil
+			}
+			sel.trace(from, "sync", f)
+			return emit(f, untracked)
 		}
 	}
 
-	var existing []string
-	for _, p := range all {
-		if _, err := os.Stat(p); err == nil {
-			existing = append(existing, p)
+	if err := gitStream(sel.gitRunner(), visit(false), append([]string{"ls-files", "-z", "--"}, pathspecs...)...); err != nil {
+		return fmt.Errorf("git ls-files failed: %w", err)
+	}
+	if err := gitStream(sel.gitRunner(), visit(true), append([]string{"ls-files", "-z", "--others", "--exclude-standard", "--"}, pathspecs...)...); err != nil {
+		return fmt.Errorf("git ls-files --others failed: %w", err)
+	}
+	return nil
+}
+
+// selectFiles collects the output of streamFilesToSync, also returning the
+// untracked subset.
+func selectFiles(sel selection) (files, untracked []string, err error) {
+	err = streamFilesToSync(sel, func(f string, isUntracked bool) error {
+		files = append(files, f)
+		if isUntracked {
+			untracked = append(untracked, f)
 		}
+		return nil
+	})
+	return files, untracked, err
+}
+
+// rsyncTransportArgs returns the rsync flags shared by every pass to remote:
+// the transfer mode and how to reach and run rsync on the other end.
+func rsyncTransportArgs(remote Remote, opts Options) []string {
+	args := []string{"-avz"}
+	if opts.DryRun {
+		args = append(args, "--dry-run")
+	}
+	if shell := rsyncShell(remote); shell != "" {
+		args = append(args, "-e", shell)
+	}
+	if opts.RsyncPath != "" {
+		args = append(args, "--rsync-path="+opts.RsyncPath)
+	}
+	if opts.HardLinks {
+		args = append(args, "-H")
+	}
+	if opts.PruneEmptyDirs {
+		args = append(args, "--prune-empty-dirs")
+	}
+	if remote.CompressChoice != "" {
+		args = append(args, "--compress-choice="+remote.CompressChoice)
+	}
+	if opts.AppendVerify {
+		args = append(args, "--append-verify")
+	} else if opts.Append {
+		args = append(args, "--append")
 	}
-	return existing, nil
+	return args
 }
 
-func rsyncToRemote(remote Remote) error {
-	files, err := filesToSync()
-	if err != nil {
-		return err
+// rsyncArgs builds the rsync argv (without "rsync" itself) that reads its file
+// list from filesFrom.
+func rsyncArgs(remote Remote, opts Options, filesFrom string) []string {
+	dest := fmt.Sprintf("%s@%s:%s", remote.User, remote.Host, remote.Path)
+
+	args := append(rsyncTransportArgs(remote, opts), "--files-from="+filesFrom)
+	if remote.FilterFile != "" {
+		args = append(args, "--filter=merge "+remote.FilterFile)
 	}
-	if len(files) == 0 {
-		fmt.Println("==> Nothing to sync (file list is empty).")
-		return nil
+	if remote.linkDest != "" {
+		args = append(args, "--link-dest="+remote.linkDest)
 	}
+	if remote.events != nil {
+		args = append(args, "--itemize-changes")
+	}
+	return append(args, "./", dest)
+}
 
-	fmt.Println("==> Files to sync:")
-	for _, f := range files {
-		fmt.Println(f)
+// emitRsync writes the file list to a temp file and prints an rsync command
+// that syncs it, without running anything. The file list is left in place so
+// the printed command can be re-run. A native remote syncs without rsync, so
+// for one it only says so.
+func emitRsync(remote Remote, opts Options) error {
+	if remote.Transport == transportNative {
+		fmt.Fprintf(os.Stderr, "==> %s uses transport = %q, which syncs over SFTP without rsync; there is no rsync command to print\n", remote.name, transportNative)
+		return nil
+	}
+	files, untracked, err := selectFiles(fileSelection(remote, opts))
+	if err != nil {
+		return err
+	}
+	if err := checkUntracked(remote, untracked, opts.Includes); err != nil {
+		return err
 	}
 
 	tmp, err := os.CreateTemp("", "buildon-files-*.txt")
 	if err != nil {
 		return fmt.Errorf("temp file: %w", err)
 	}
+	w := bufio.NewWriterSize(tmp, 1<<20)
 	for _, f := range files {
-		if _, err := tmp.WriteString(f + "\n"); err != nil {
-			tmp.Close()
-			os.Remove(tmp.Name())
-			return fmt.Errorf("write temp list: %w", err)
-		}
+		w.WriteString(f + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write temp list: %w", err)
 	}
 	tmp.Close()
-	defer os.Remove(tmp.Name())
 
-	dest := fmt.Sprintf("%s@%s:%s", remote.User, remote.Host, remote.Path)
+	wd, _ := os.Getwd()
+	fmt.Fprintf(os.Stderr, "==> File list kept at %s; run the command from %s\n", tmp.Name(), wd)
+	fmt.Println(shellJoin(append([]string{"rsync"}, rsyncArgs(remote, opts, tmp.Name())...)))
+	return nil
+}
 
+// rsyncToRemote syncs the selected files to the remote path and returns
+// them. The file list is streamed to rsync's stdin while git is still
+// enumerating it, so transfer starts before selection has finished on large
+// trees. Each file is listed on stdout as it is handed to rsync.
+func rsyncToRemote(ctx context.Context, remote Remote, opts Options) ([]string, error) {
 	if !hasCmd("rsync") {
-		return fmt.Errorf("rsync not found on PATH (install rsync or run via WSL/Git Bash/MSYS2)")
+		return nil, fmt.Errorf("rsync not found on PATH (install rsync or run via WSL/Git Bash/MSYS2)")
 	}
 
-	args := []string{
-		"-avz",
-		"--files-from=" + tmp.Name(),
-		"./",
-		dest,
+	produce := func(emit func(string, bool) error) error {
+		return streamFilesToSync(fileSelection(remote, opts), emit)
 	}
-	fmt.Println("==> Syncing via rsync...")
-	cmd := exec.Command("rsync", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if remote.UntrackedPolicy == untrackedError {
+		// The whole selection has to be known before rsync starts, so it
+		// can be refused without syncing anything.
+		files, untracked, err := selectFiles(fileSelection(remote, opts))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkUntracked(remote, untracked, opts.Includes); err != nil {
+			return nil, err
+		}
+		isUntracked := map[string]bool{}
+		for _, f := range untracked {
+			isUntracked[f] = true
+		}
+		produce = func(emit func(string, bool) error) error {
+			for _, f := range files {
+				if err := emit(f, isUntracked[f]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	fmt.Fprintln(remote.stdout(), "==> Syncing via rsync...")
+	fmt.Fprintln(remote.stdout(), "==> Files to sync:")
+	cmd := commandContext(ctx, "rsync", rsyncArgs(remote, opts, "-")...)
+	cmd.Stdout = remote.stdout()
+	if remote.events != nil {
+		cmd.Stdout = &itemizeWriter{w: remote.stdout(), log: remote.events, remote: remote}
+	}
+	cmd.Stderr = remote.stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := runner.Start(cmd); err != nil {
+		return nil, err
+	}
+
+	var files, untracked []string
+	w := bufio.NewWriterSize(stdin, 1<<20)
+	err = produce(func(f string, isUntracked bool) error {
+		files = append(files, f)
+		if isUntracked {
+			untracked = append(untracked, f)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fmt.Fprintln(remote.stdout(), f)
+		_, err := w.WriteString(f + "\n")
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	stdin.Close()
+	if err != nil && !errors.Is(err, syscall.EPIPE) {
+		// Don't let rsync finish a partial list.
+		cmd.Process.Kill()
+		runner.Wait(cmd)
+		return nil, err
+	}
+	if err := rsyncError(remote.stderr(), runner.Wait(cmd)); err != nil {
+		return nil, err
+	}
+
+	if remote.UntrackedPolicy == untrackedWarn {
+		checkUntracked(remote, untracked, opts.Includes)
+	}
+
+	if len(files) == 0 {
+		fmt.Fprintln(remote.stdout(), "==> Nothing to sync (file list is empty).")
+		return nil, nil
+	}
+	if opts.DryRun {
+		return files, nil
+	}
+	return files, applyChmodMap(ctx, remote, files)
+}
+
+// sshOptions returns the ssh flags shared by every connection to remote. They
+// are placed before the destination in ssh invocations and inside rsync's -e.
+func sshOptions(remote Remote) []string {
+	var opts []string
+	if remote.SSHConfig != "" {
+		opts = append(opts, "-F", remote.SSHConfig)
+	}
+	if remote.ipFamily != "" {
+		opts = append(opts, "-"+remote.ipFamily)
+	}
+	if remote.Port != 0 {
+		opts = append(opts, "-p", strconv.Itoa(remote.Port))
+	}
+	if remote.IdentityFile != "" {
+		opts = append(opts, "-i", remote.IdentityFile)
+	}
+	for _, o := range remote.SSHOptions {
+		opts = append(opts, "-o", o)
+	}
+	return opts
+}
+
+// sshCommand builds an ssh invocation with the remote's shared options
+// followed by args.
+func sshCommand(remote Remote, args ...string) *exec.Cmd {
+	return sshCommandContext(context.Background(), remote, args...)
+}
+
+// sshCommandContext is sshCommand for a command that stops when ctx is
+// cancelled.
+func sshCommandContext(ctx context.Context, remote Remote, args ...string) *exec.Cmd {
+	return commandContext(ctx, "ssh", append(sshOptions(remote), args...)...)
+}
+
+// rsyncShell returns the value for rsync's -e flag, or "" when the remote
+// needs no ssh options and rsync's default transport will do.
+func rsyncShell(remote Remote) string {
+	opts := sshOptions(remote)
+	if len(opts) == 0 {
+		return ""
+	}
+	parts := []string{"ssh"}
+	for _, o := range opts {
+		parts = append(parts, rsyncQuote(o))
+	}
+	return strings.Join(parts, " ")
+}
+
+// rsyncQuote quotes s for rsync's -e parser, which splits on spaces and
+// honors single and double quotes but not backslashes. Quoted pieces next to
+// each other join into one word, so a single quote is written as "'".
+func rsyncQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " '\"") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
 }
 
 func quotePS(s string) string {
@@ -157,88 +588,912 @@ func quotePS(s string) string {
 	return `'` + s + `'`
 }
 
-func openInteractiveShell(remote Remote) error {
+// commandArgs composes the ssh arguments (after the shared options) that
+// run command in the remote path, or open an interactive shell there when
+// command is empty.
+func commandArgs(remote Remote, command []string) []string {
 	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+	env := commandEnv(remote, len(command) == 0 || remote.tty)
 
 	if remote.Shell == "powershell" {
+		if len(command) == 0 {
+			ps := fmt.Sprintf(
+				`$p=%s; New-Item -ItemType Directory -Force -Path $p *> $null; Set-Location -Path $p; %s`,
+				quotePS(remote.Path), envPS(env),
+			)
+			return []string{"-t", target, "powershell", "-NoProfile", "-NoLogo", "-NoExit", "-Command", ps}
+		}
+		clean := ""
+		if remote.cleanEnv {
+			clean = cleanEnvPS(remote.keepEnv)
+		}
 		ps := fmt.Sprintf(
-			`$p=%s; New-Item -ItemType Directory -Force -Path $p *> $null; Set-Location -Path $p;`,
+			`$p=%s; Set-Location -Path $p; %s%s%s`,
 			quotePS(remote.Path),
+			clean,
+			envPS(env),
+			strings.Join(command, " "),
 		)
-		sshArgs := []string{"-t", target, "powershell", "-NoProfile", "-NoLogo", "-NoExit", "-Command", ps}
-		c := exec.Command("ssh", sshArgs...)
-		c.Stdin = os.Stdin
-		c.Stdout = os.Stdout
-		c.Stderr = os.Stderr
-		return c.Run()
-	}
-
-	cmdStr := fmt.Sprintf("mkdir -p %s && cd %s && exec ${SHELL:-bash} -l",
-		shellQuotePOSIX(remote.Path), shellQuotePOSIX(remote.Path))
-	sshArgs := []string{"-t", target, cmdStr}
-	c := exec.Command("ssh", sshArgs...)
-	c.Stdin = os.Stdin
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	return c.Run()
-}
+		args := []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
+		if remote.tty {
+			args = append([]string{"-tt"}, args...)
+		}
+		return args
+	}
 
-func runRemoteCommand(remote Remote, command []string) error {
 	if len(command) == 0 {
-		return openInteractiveShell(remote)
+		cmdStr := fmt.Sprintf("%s && cd %s && %sexec ${SHELL:-bash} -l",
+			mkdirPOSIX(remote), shellQuotePOSIX(remote.Path), envPOSIX(env))
+		return []string{"-t", target, cmdStr}
+	}
+	run := envPOSIX(env) + strings.Join(command, " ")
+	if remote.cleanEnv {
+		run = cleanEnvPOSIX(remote.keepEnv, env, strings.Join(command, " "))
+	}
+	cmdStr := fmt.Sprintf("%s && %s", cdPOSIX(remote), run)
+	if remote.pidFile != "" {
+		// remote_tmp may be relative to the login directory, so resolve the
+		// pid file's path before changing into the remote path.
+		tmp := shellQuotePOSIX(remoteTmp(remote))
+		cmdStr = fmt.Sprintf(`mkdir -p %s && f="$(cd %s && pwd)/%s" && %s && { echo $$ > "$f"; %s; s=$?; rm -f "$f"; exit $s; }`,
+			tmp, tmp, remote.pidFile, cdPOSIX(remote), run)
+	}
+	args := []string{target, cmdStr}
+	if remote.tty {
+		args = append([]string{"-tt"}, args...)
+	}
+	return args
+}
+
+// cdPOSIX changes into the remote path, creating it first unless it is
+// known to exist. A known path that has gone missing is still created when
+// the cd fails.
+func cdPOSIX(remote Remote) string {
+	p := shellQuotePOSIX(remote.Path)
+	if remote.pathKnown {
+		return fmt.Sprintf("{ cd %s 2>/dev/null || { %s && cd %s; }; }", p, mkdirPOSIX(remote), p)
+	}
+	return fmt.Sprintf("%s && cd %s", mkdirPOSIX(remote), p)
+}
+
+// printRemoteCommand shows what runRemoteCommand would do: the command string
+// the remote shell receives (ssh joins its arguments with spaces) and the full
+// local ssh argv.
+func printRemoteCommand(remote Remote, command []string) {
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+	if native, cmdStr := nativeCommand(remote, command); native {
+		fmt.Fprintf(remote.stdout(), "==> Would run on %s (native transport): %s\n", target, cmdStr)
+		return
+	}
+	args := commandArgs(remote, command)
+	for i, a := range args {
+		if a == target {
+			fmt.Fprintf(remote.stdout(), "==> Would run on %s: %s\n", target, strings.Join(args[i+1:], " "))
+			break
+		}
+	}
+	argv := append([]string{"ssh"}, sshOptions(remote)...)
+	fmt.Fprintf(remote.stdout(), "==> ssh argv: %s\n", shellJoin(append(argv, args...)))
+}
+
+func openInteractiveShell(ctx context.Context, remote Remote) error {
+	c := sshCommandContext(ctx, remote, commandArgs(remote, nil)...)
+	c.Stdin = remote.stdin()
+	c.Stdout = remote.stdout()
+	c.Stderr = remote.stderr()
+	return runCmd(c)
+}
+
+// bootstrapMarker is created in the remote path once Bootstrap has succeeded.
+const bootstrapMarker = ".buildon-bootstrapped"
+
+// runBootstrap runs the remote's Bootstrap command unless the marker file
+// shows it already succeeded in this remote path.
+func runBootstrap(ctx context.Context, remote Remote) error {
+	if remote.Bootstrap == "" {
+		return nil
 	}
 	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
 
+	var sshArgs []string
 	if remote.Shell == "powershell" {
 		ps := fmt.Sprintf(
-			`$p=%s; Set-Location -Path $p; %s`,
-			quotePS(remote.Path),
-			strings.Join(command, " "),
+			`$p=%s; New-Item -ItemType Directory -Force -Path $p *> $null; Set-Location -Path $p; `+
+				`if (-not (Test-Path %s)) { Write-Output '==> Running bootstrap...'; $global:LASTEXITCODE=0; %s; `+
+				`if (-not $? -or $LASTEXITCODE -ne 0) { exit 1 }; New-Item -ItemType File -Path %s *> $null }`,
+			quotePS(remote.Path), quotePS(bootstrapMarker), remote.Bootstrap, quotePS(bootstrapMarker),
 		)
-		sshArgs := []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
-		fmt.Printf("==> Running on %s: %s\n", target, strings.Join(command, " "))
-		c := exec.Command("ssh", sshArgs...)
-		c.Stdin = os.Stdin
-		c.Stdout = os.Stdout
-		c.Stderr = os.Stderr
-		return c.Run()
-	}
-
-	cmdStr := fmt.Sprintf("mkdir -p %s && cd %s && %s",
-		shellQuotePOSIX(remote.Path), shellQuotePOSIX(remote.Path), strings.Join(command, " "))
-	sshArgs := []string{target, cmdStr}
-	fmt.Printf("==> Running on %s: %s\n", target, strings.Join(command, " "))
-	c := exec.Command("ssh", sshArgs...)
-	c.Stdin = os.Stdin
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	return c.Run()
+		sshArgs = []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
+	} else {
+		cmdStr := fmt.Sprintf(
+			"%s && cd %s && if [ ! -e %s ]; then echo '==> Running bootstrap...' && (\n%s\n) && touch %s; fi",
+			mkdirPOSIX(remote), shellQuotePOSIX(remote.Path), bootstrapMarker, remote.Bootstrap, bootstrapMarker,
+		)
+		sshArgs = []string{target, cmdStr}
+	}
+
+	c := sshCommandContext(ctx, remote, sshArgs...)
+	c.Stdin = remote.stdin()
+	c.Stdout = remote.stdout()
+	c.Stderr = remote.stderr()
+	if err := runRemoteCmd(ctx, remote, c); err != nil {
+		return fmt.Errorf("bootstrap failed on %s: %w", target, err)
+	}
+	return nil
+}
+
+func runRemoteCommand(ctx context.Context, remote Remote, opts Options, command []string) error {
+	if len(command) == 0 {
+		return openInteractiveShell(ctx, remote)
+	}
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+
+	fmt.Fprintf(remote.stdout(), "==> Running on %s: %s\n", target, strings.Join(command, " "))
+	if native, cmdStr := nativeCommand(remote, command); native {
+		return runNativeCommand(ctx, remote, cmdStr)
+	}
+	if opts.Timeout <= 0 && remote.pidFile == "" {
+		c := sshCommandContext(ctx, remote, commandArgs(remote, command)...)
+		c.Stdin = remote.stdin()
+		c.Stdout = remote.stdout()
+		c.Stderr = remote.stderr()
+		return runCmd(c)
+	}
+
+	// waitWithTimeout handles cancellation itself, so it can stop the
+	// remote command rather than just the connection.
+	c := sshCommand(remote, commandArgs(remote, command)...)
+	c.Stdin = remote.stdin()
+	c.Stdout = remote.stdout()
+	c.Stderr = remote.stderr()
+	if err := runner.Start(c); err != nil {
+		return err
+	}
+	return waitWithTimeout(ctx, remote, opts, c)
 }
 
 func shellQuotePOSIX(s string) string {
 	return "'" + strings.ReplaceAll(s, "'", "'\"'\"'") + "'"
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: buildon <remote-name> [command...]")
+// Options holds the command-line flags that apply to a single run.
+type Options struct {
+	SSHConfig       string
+	PrintConfigPath bool
+	Pathspecs       []string
+	RefreshCaps     bool
+	RsyncPath       string
+	EmitRsync       bool
+	Explain         bool
+	Append          bool
+	AppendVerify    bool
+	WarnUntracked   bool
+	KeepGoing       bool
+	Jobs            int
+	FailFast        bool
+	IPv4            bool
+	IPv6            bool
+	Script          bool
+	HardLinks       bool
+	DryRun          bool
+	ByCommit        bool
+	Timeout         time.Duration
+	KillSignal      string
+	KillGrace       time.Duration
+	ExtraSources    []string
+	AllowOverlap    bool
+	Term            string
+	Record          string
+	Replay          string
+	SerialCommand   bool
+	LogDir          string
+	Includes        []string
+	Local           bool
+	Interactive     bool
+	NoGit           bool
+	FromManifest    string
+	FilterFile      string
+	PruneEmptyDirs  bool
+	DebugSelection  bool
+	CleanEnv        bool
+	KeepEnv         []string
+	CommandFile     string
+	NoUpdateCheck   bool
+	Watch           bool
+	WatchRestart    bool
+	WatchCommand    string
+	WatchEvents     string
+	ArtifactsDir    string
+	TUI             bool
+	CompressChoice  string
+	Plan            bool
+	Yes             bool
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(fs.Output(), "Usage: buildon [flags] <remote-name|@group>[,...] [flags] [--] [command...]")
+		fmt.Fprintln(fs.Output(), "       buildon clean [--remote <name>]")
+		fmt.Fprintln(fs.Output(), "       buildon selfupdate [--yes]")
+		fs.PrintDefaults()
+	}
+}
+
+// parseArgs splits args into buildon's flags, the remote name and the remote
+// command. Flags may appear before or directly after the remote name; parsing
+// stops at the first non-flag argument after it, or at "--", and everything
+// from there on is the command. An empty command opens an interactive shell.
+// With isTarget set, the remote name is optional: when it is missing, or
+// the first argument isn't one isTarget accepts, the remote name is returned
+// as "" and everything from that argument on is the command.
+func parseArgs(args []string, isTarget func(string) bool) (Options, string, []string) {
+	return parseArgsWithDefaults(args, nil, isTarget)
+}
+
+// parseArgsWithDefaults is parseArgs with defaults, a flags-only argument
+// list parsed ahead of args so that args override it.
+func parseArgsWithDefaults(args, defaults []string, isTarget func(string) bool) (Options, string, []string) {
+	var opts Options
+	fs := flag.NewFlagSet("buildon", flag.ExitOnError)
+	fs.StringVar(&opts.SSHConfig, "ssh-config", "", "use an alternative ssh config `file` (passed to ssh as -F)")
+	fs.BoolVar(&opts.PrintConfigPath, "print-config-path", false, "print the resolved config file path and exit")
+	fs.Var((*stringList)(&opts.Pathspecs), "pathspec", "only sync files matching git `pathspec` (repeatable)")
+	fs.BoolVar(&opts.RefreshCaps, "refresh-caps", false, "re-probe which tools the remote has instead of using the cache")
+	fs.StringVar(&opts.RsyncPath, "rsync-path", "", "run `cmd` as rsync on the remote, e.g. \"sudo rsync\"")
+	fs.BoolVar(&opts.EmitRsync, "emit-rsync", false, "print the rsync command instead of running it, then exit")
+	fs.BoolVar(&opts.Explain, "explain", false, "print the remote's resolved settings and where each came from, then exit")
+	fs.BoolVar(&opts.Append, "append", false, "only transfer data appended to files that already exist remotely (rsync --append)")
+	fs.BoolVar(&opts.AppendVerify, "append-verify", false, "like --append, but resend files whose existing data doesn't match")
+	fs.BoolVar(&opts.WarnUntracked, "warn-untracked", false, "list any synced files that are untracked in git")
+	fs.Var((*stringList)(&opts.Includes), "include", "allow untracked files matching `pattern` past untracked_policy warn/error (repeatable)")
+	fs.BoolVar(&opts.KeepGoing, "keep-going", false, "with several remotes, still start the remotes and commands that are waiting after a failure")
+	fs.IntVar(&opts.Jobs, "jobs", 0, "with several remotes, run at most `n` at a time (default: all at once; 1 runs them in turn)")
+	fs.BoolVar(&opts.FailFast, "fail-fast", false, "with several remotes, stop the ones still running as soon as one fails")
+	fs.BoolVar(&opts.IPv4, "ipv4", false, "force ssh and rsync to use IPv4")
+	fs.BoolVar(&opts.IPv6, "ipv6", false, "force ssh and rsync to use IPv6")
+	fs.BoolVar(&opts.Script, "script", false, "treat the command's first word as a repo script: require it to be synced and make it executable")
+	fs.BoolVar(&opts.HardLinks, "hard-links", false, "preserve hard links between synced files (rsync -H)")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "show what would be synced and the exact remote command, without changing anything")
+	fs.BoolVar(&opts.ByCommit, "by-commit", false, "sync into <path>/<short HEAD sha>, hard-linking unchanged files from the parent commit's dir")
+	fs.DurationVar(&opts.Timeout, "timeout", 0, "stop the remote command if it runs longer than `duration`")
+	fs.StringVar(&opts.KillSignal, "kill-signal", "TERM", "`signal` sent to the remote command when --timeout fires")
+	fs.DurationVar(&opts.KillGrace, "kill-grace", 10*time.Second, "how long to wait after --kill-signal before sending KILL")
+	fs.Var((*stringList)(&opts.ExtraSources), "extra-source", "also sync local `dir:subdir` into <path>/<subdir> (repeatable)")
+	fs.BoolVar(&opts.AllowOverlap, "allow-overlap", false, "let --extra-source passes overwrite files synced by earlier passes")
+	fs.StringVar(&opts.Term, "term", "", "set TERM for the remote command (defaults to the local $TERM when a pty is allocated)")
+	fs.StringVar(&opts.Record, "record", "", "log every git/rsync/ssh invocation with timing to `file`")
+	fs.StringVar(&opts.Replay, "replay", "", "fail if this run's invocations differ from those recorded in `file`")
+	fs.BoolVar(&opts.SerialCommand, "serial-command", false, "with several remotes, sync them in parallel but run the command on one at a time, in order")
+	fs.StringVar(&opts.LogDir, "log-dir", "", "with several remotes, write each one's output to `dir`/<remote>.log and show only progress")
+	fs.BoolVar(&opts.Local, "local", false, "after syncing, run the command locally in the repo root instead of on the remote")
+	fs.BoolVar(&opts.Interactive, "interactive", false, "allocate a pty for the remote command, for tools that prompt or draw progress")
+	fs.BoolVar(&opts.Interactive, "t", false, "shorthand for --interactive")
+	fs.BoolVar(&opts.NoGit, "no-git", false, "sync every file in the directory instead of asking git which to sync")
+	fs.StringVar(&opts.FromManifest, "from-manifest", "", "sync exactly the paths listed in `file` (one per line, or NUL-separated) instead of asking git")
+	fs.StringVar(&opts.FilterFile, "filter-file", "", "apply the rsync filter rules in `file` to the sync (rsync --filter=\"merge file\")")
+	fs.BoolVar(&opts.PruneEmptyDirs, "prune-empty-dirs", false, "don't create remote directories that end up empty after filtering (rsync -m)")
+	fs.BoolVar(&opts.DebugSelection, "debug-selection", false, "print to stderr why each file is or isn't selected for syncing")
+	fs.BoolVar(&opts.CleanEnv, "clean-env", false, "run the remote command with only PATH, env and --keep-env variables set")
+	fs.Var((*stringList)(&opts.KeepEnv), "keep-env", "with --clean-env, keep the session's `var` too (repeatable)")
+	fs.StringVar(&opts.CommandFile, "command-file", "", "run the commands in `file`, one per line, instead of a single command")
+	fs.BoolVar(&opts.NoUpdateCheck, "no-update-check", false, "don't check for a newer buildon release (also BUILDON_NO_UPDATE_CHECK=1)")
+	fs.BoolVar(&opts.Watch, "watch", false, "after the first run, sync and run again whenever a synced file changes")
+	fs.BoolVar(&opts.TUI, "tui", false, "with several remotes, show a live table of their progress instead of their output")
+	fs.StringVar(&opts.CompressChoice, "compress-choice", "", "compress transfers with `algo` (zstd, lz4, zlib; rsync --compress-choice, needs rsync 3.2.0)")
+	fs.BoolVar(&opts.Plan, "plan", false, "print what will be synced and run on each remote and ask before doing it")
+	fs.BoolVar(&opts.Yes, "yes", false, "with --plan, go ahead without asking")
+	fs.StringVar(&opts.WatchCommand, "watch-command", "", "with --watch, run `cmd` after each change instead of the command (which still runs first)")
+	fs.BoolVar(&opts.WatchRestart, "watch-restart", false, "with --watch, stop a running command when files change and start over")
+	fs.StringVar(&opts.WatchEvents, "watch-events", "", "with --watch, write a JSON line for each file a sync changes to `file` (- for stdout)")
+	fs.StringVar(&opts.ArtifactsDir, "artifacts-dir", "", "pull the remote's artifacts into `dir` instead of the current directory")
+	fs.Usage = usage(fs)
+	fs.Parse(defaults)
+	if fs.NArg() > 0 {
+		log.Fatalf("unexpected argument %q in profile flags", fs.Arg(0))
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		if opts.PrintConfigPath || isTarget != nil {
+			return opts, "", nil
+		}
+		fs.Usage()
 		os.Exit(1)
 	}
 
-	remoteName := os.Args[1]
-	command := os.Args[2:]
+	remoteName := fs.Arg(0)
+	if isTarget != nil && !isTarget(remoteName) {
+		remoteName = ""
+	} else {
+		fs.Parse(fs.Args()[1:])
+	}
 
-	cfg := loadConfig()
-	remote, ok := cfg.Remote[remoteName]
+	sig, err := parseKillSignal(opts.KillSignal)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.KillSignal = sig
+	return opts, remoteName, fs.Args()
+}
+
+// applyOptions overlays command-line flags onto the remote's config.
+func applyOptions(remote Remote, opts Options) (Remote, error) {
+	if opts.SSHConfig != "" {
+		remote.SSHConfig = opts.SSHConfig
+		remote.setSource("ssh_config", "flag --ssh-config")
+	}
+	if remote.SSHConfig != "" {
+		path, err := expandHome(remote.SSHConfig)
+		if err != nil {
+			return remote, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return remote, fmt.Errorf("ssh config %s: %w", remote.SSHConfig, err)
+		}
+		remote.SSHConfig = path
+	}
+	if remote.IdentityFile != "" {
+		path, err := expandHome(remote.IdentityFile)
+		if err != nil {
+			return remote, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return remote, fmt.Errorf("identity_file %s: %w", remote.IdentityFile, err)
+		}
+		remote.IdentityFile = path
+	}
+	if remote.Port < 0 || remote.Port > 65535 {
+		return remote, fmt.Errorf("port: %d is not a valid port", remote.Port)
+	}
+	for _, o := range remote.SSHOptions {
+		if k, _, ok := strings.Cut(o, "="); !ok || strings.TrimSpace(k) == "" {
+			return remote, fmt.Errorf("ssh_options: %q is not Key=Value", o)
+		}
+	}
+	if opts.CompressChoice != "" {
+		remote.CompressChoice = opts.CompressChoice
+		remote.setSource("compress_choice", "flag --compress-choice")
+	}
+	if opts.FilterFile != "" {
+		remote.FilterFile = opts.FilterFile
+		remote.setSource("filter_file", "flag --filter-file")
+	}
+	if err := validateArtifacts(remote.Artifacts); err != nil {
+		return remote, err
+	}
+	if opts.ArtifactsDir != "" {
+		remote.ArtifactsDir = opts.ArtifactsDir
+		remote.setSource("artifacts_dir", "flag --artifacts-dir")
+		remote.sharedArtifacts = true
+	}
+	if remote.ArtifactsDir == "" {
+		remote.ArtifactsDir = "."
+		remote.sharedArtifacts = true
+	} else {
+		path, err := expandHome(remote.ArtifactsDir)
+		if err != nil {
+			return remote, err
+		}
+		remote.ArtifactsDir = path
+	}
+	if remote.FilterFile != "" {
+		path, err := expandHome(remote.FilterFile)
+		if err != nil {
+			return remote, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return remote, fmt.Errorf("filter file %s: %w", remote.FilterFile, err)
+		}
+		remote.FilterFile = path
+	}
+	switch {
+	case opts.IPv4 && opts.IPv6:
+		return remote, errors.New("--ipv4 and --ipv6 are mutually exclusive")
+	case opts.IPv4:
+		remote.ipFamily = "4"
+	case opts.IPv6:
+		remote.ipFamily = "6"
+	}
+	if opts.ByCommit {
+		sha, err := gitOutput("rev-parse", "--short", "HEAD")
+		if err != nil {
+			return remote, errors.New("--by-commit needs a commit to name the directory after (is HEAD unborn?)")
+		}
+		remote.Path = strings.TrimSuffix(remote.Path, "/") + "/" + strings.TrimSpace(string(sha))
+		remote.setSource("path", "flag --by-commit")
+		if parent, err := outputCmd(exec.Command("git", "rev-parse", "--short", "HEAD^")); err == nil {
+			remote.linkDest = "../" + strings.TrimSpace(string(parent))
+		}
+	}
+	if opts.Interactive {
+		remote.tty = true
+	}
+	if opts.Timeout > 0 || opts.WatchRestart {
+		if remote.Shell == "powershell" {
+			remote.tty = true
+		} else {
+			remote.pidFile = newPIDFile()
+		}
+	}
+	if opts.WarnUntracked && (remote.UntrackedPolicy == "" || remote.UntrackedPolicy == untrackedInclude) {
+		remote.UntrackedPolicy = untrackedWarn
+		remote.setSource("untracked_policy", "flag --warn-untracked")
+	}
+	if err := validateUntrackedPolicy(remote.UntrackedPolicy); err != nil {
+		return remote, err
+	}
+	if err := validateChmodMap(remote.ChmodMap); err != nil {
+		return remote, err
+	}
+	if m := remote.PathMode; m != "" && !octalMode.MatchString(m) && !symbolicMode.MatchString(m) {
+		return remote, fmt.Errorf("path_mode: bad mode %q (want e.g. 0775 or g+w)", m)
+	}
+	for k := range remote.Env {
+		if !envName.MatchString(k) {
+			return remote, fmt.Errorf("env: invalid variable name %q", k)
+		}
+	}
+	for _, k := range opts.KeepEnv {
+		if !envName.MatchString(k) {
+			return remote, fmt.Errorf("--keep-env: invalid variable name %q", k)
+		}
+	}
+	if err := validateTransport(remote, opts); err != nil {
+		return remote, err
+	}
+	remote.cleanEnv, remote.keepEnv = opts.CleanEnv, opts.KeepEnv
+	return remote, nil
+}
+
+// commandEnv returns the env exported for a remote command. When a pty is
+// allocated, TERM defaults to the local $TERM so colors and line editing
+// match the local terminal.
+func commandEnv(remote Remote, pty bool) map[string]string {
+	if _, ok := remote.Env["TERM"]; ok || !pty {
+		return remote.Env
+	}
+	if term := os.Getenv("TERM"); term != "" {
+		return mergeEnv(remote.Env, map[string]string{"TERM": term})
+	}
+	return remote.Env
+}
+
+// mergeEnv returns base overlaid with over, without modifying either.
+func mergeEnv(base, over map[string]string) map[string]string {
+	if len(over) == 0 {
+		return base
+	}
+	out := make(map[string]string, len(base)+len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		out[k] = v
+	}
+	return out
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envPOSIX renders env as an export prefix for a POSIX command string.
+func envPOSIX(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, k := range sortedKeys(env) {
+		parts = append(parts, k+"="+shellQuotePOSIX(env[k]))
+	}
+	return "export " + strings.Join(parts, " ") + " && "
+}
+
+// envPS renders env as $env: assignments for a PowerShell command string.
+func envPS(env map[string]string) string {
+	var b strings.Builder
+	for _, k := range sortedKeys(env) {
+		fmt.Fprintf(&b, "$env:%s=%s; ", k, quotePS(env[k]))
+	}
+	return b.String()
+}
+
+// shellJoin renders argv as a POSIX shell command line, quoting only the
+// arguments that need it.
+func shellJoin(argv []string) string {
+	out := make([]string, len(argv))
+	for i, a := range argv {
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:@,+%") == "" {
+			out[i] = a
+		} else {
+			out[i] = shellQuotePOSIX(a)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// resolveHost runs the remote's RemoteResolver, if any, and fills in Host
+// (and User, for user@host output) from the first line it prints. It runs
+// once per invocation; the result is not persisted.
+func resolveHost(remote Remote) (Remote, error) {
+	if remote.RemoteResolver == "" {
+		return remote, nil
+	}
+
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", remote.RemoteResolver)
+	} else {
+		c = exec.Command("sh", "-c", remote.RemoteResolver)
+	}
+	c.Stderr = os.Stderr
+	out, err := outputCmd(c)
+	if err != nil {
+		return remote, fmt.Errorf("remote_resolver %q failed: %w", remote.RemoteResolver, err)
+	}
+
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return remote, fmt.Errorf("remote_resolver %q printed no host", remote.RemoteResolver)
+	}
+	if user, host, ok := strings.Cut(line, "@"); ok {
+		remote.User = user
+		remote.setSource("user", "remote_resolver")
+		line = host
+	}
+	remote.Host = line
+	remote.setSource("host", "remote_resolver")
+	return remote, nil
+}
+
+// isTarget reports whether a remote-name argument names something to run on
+// rather than starting a command: a remote in cfg, or anything written as a
+// group, a profile or a list, so that a mistyped one is still reported.
+func (cfg Config) isTarget(name string) bool {
+	if isGroupRef(name) || isProfileRef(name) || strings.Contains(name, ",") {
+		return true
+	}
+	_, ok := cfg.Remote[name]
+	return ok
+}
+
+// resolveRemote looks up a remote by name and applies the profile env and
+// command-line flags on top of its config.
+func resolveRemote(cfg Config, name string, opts Options, profileEnv map[string]string) (Remote, error) {
+	remote, ok := cfg.Remote[name]
 	if !ok {
-		log.Fatalf("no remote named %s", remoteName)
+		return remote, fmt.Errorf("no remote named %s", name)
+	}
+	remote.name = name
+
+	remote = applyProject(remote, cfg.project)
+	remote.Env = mergeEnv(remote.Env, profileEnv)
+	if opts.Term != "" {
+		remote.Env = mergeEnv(remote.Env, map[string]string{"TERM": opts.Term})
+	}
+	remote, err := applyOptions(remote, opts)
+	if err != nil {
+		return remote, err
+	}
+	return resolveHost(remote)
+}
+
+// syncAndRun syncs the working tree to remote and runs command there, or
+// opens a shell when command is empty.
+func syncAndRun(ctx context.Context, remote Remote, opts Options, command []string) error {
+	files, err := syncRemote(ctx, remote, opts)
+	if err != nil {
+		return err
+	}
+	return runSynced(ctx, remote, opts, command, files)
+}
+
+// syncRemote is the sync half of syncAndRun: it brings the remote path up to
+// date, bootstraps it if needed, and returns the synced files.
+func syncRemote(ctx context.Context, remote Remote, opts Options) ([]string, error) {
+	// The native transport needs no rsync, and creates the path itself.
+	native := remote.Transport == transportNative
+	if !native {
+		caps, err := remoteCapabilities(ctx, remote, opts.RefreshCaps || ignoreCaches(opts))
+		if err != nil {
+			fmt.Fprintf(remote.stderr(), "warning: %v\n", err)
+		} else if opts.RsyncPath == "" {
+			if err := caps.Require(remote, "rsync"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := runPreSyncRemote(ctx, remote, opts); err != nil {
+		return nil, err
+	}
+	if !native {
+		if err := createRemotePath(ctx, remote, opts); err != nil {
+			return nil, err
+		}
+	}
+	transfer := rsyncToRemote
+	if native {
+		transfer = nativeSync
+	}
+	files, err := transfer(ctx, remote, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.DryRun && len(files) > 0 {
+		rememberRemotePath(remote)
+	}
+	if err := syncExtraSources(ctx, remote, opts, files); err != nil {
+		return nil, err
+	}
+
+	if !opts.DryRun {
+		if err := runBootstrap(ctx, remote); err != nil {
+			return nil, err
+		}
+	} else if remote.Bootstrap != "" {
+		fmt.Fprintf(remote.stdout(), "==> Would run bootstrap unless %s exists: %s\n", bootstrapMarker, remote.Bootstrap)
+	}
+	return files, nil
+}
+
+// runSynced is the run half of syncAndRun, given the files syncRemote synced.
+func runSynced(ctx context.Context, remote Remote, opts Options, command, files []string) error {
+	var err error
+	if opts.CommandFile != "" {
+		err = runCommandFile(ctx, remote, opts, files)
+	} else {
+		err = runOneCommand(ctx, remote, opts, command, files)
+	}
+	if err != nil || opts.Local || (len(command) == 0 && opts.CommandFile == "") {
+		return err
+	}
+	if remote.PostRunRemote != "" {
+		hookOpts := opts
+		hookOpts.Script = false
+		if err := runOneCommand(ctx, remote, hookOpts, []string{remote.PostRunRemote}, files); err != nil {
+			return fmt.Errorf("post_run_remote failed: %w", err)
+		}
+	}
+	return pullArtifacts(ctx, remote, opts)
+}
+
+// runOneCommand runs command for runSynced, locally with --local, or opens a
+// shell when command is empty.
+func runOneCommand(ctx context.Context, remote Remote, opts Options, command, files []string) error {
+	if opts.Local {
+		return runLocalCommand(ctx, remote, opts, command)
+	}
+	if len(command) == 0 && remote.Transport == transportNative {
+		return fmt.Errorf("transport = %q can't open an interactive shell; give a command to run, or use transport = \"exec\"", transportNative)
+	}
+	command, err := prepareScript(remote, command, files, opts.Script)
+	if err != nil {
+		return err
+	}
+	if remote.pidFile != "" && !opts.DryRun {
+		if err := checkRemoteTmp(ctx, remote); err != nil {
+			return err
+		}
+	}
+	// Before the dry-run print, so it shows the command that would really
+	// run.
+	remote.pathKnown = !ignoreCaches(opts) && remotePathKnown(remote)
+	if opts.DryRun {
+		printRemoteCommand(remote, command)
+		return nil
+	}
+	if err := runRemoteCommand(ctx, remote, opts, command); err != nil {
+		// A cancelled run (Ctrl-C, a watch restart, a fail-fast stop)
+		// didn't fail on its own, so there is nothing to diagnose.
+		if len(command) > 0 && ctx.Err() == nil {
+			runFailureDiagnostics(ctx, remote)
+		}
+		return err
+	}
+	rememberRemotePath(remote)
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "clean" {
+		runClean(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selfupdate" {
+		runSelfUpdate(os.Args[2:])
+		return
+	}
+
+	// With a default remote, "buildon make test" runs make test there, so the
+	// config is needed to tell a remote name from a command.
+	proj := loadProject()
+	var cfg Config
+	var isTarget func(string) bool
+	if proj.DefaultRemote != "" {
+		cfg = loadConfig(proj)
+		isTarget = cfg.isTarget
+	}
+	opts, remoteName, command := parseArgs(os.Args[1:], isTarget)
+
+	if opts.PrintConfigPath {
+		path, err := configPath()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(path)
+		return
 	}
 
-	if err := rsyncToRemote(remote); err != nil {
+	if remoteName == "" {
+		remoteName = proj.DefaultRemote
+		if len(command) == 0 && proj.DefaultCommand != "" {
+			command = []string{proj.DefaultCommand}
+		}
+	}
+
+	if isTarget == nil {
+		cfg = loadConfig(proj)
+	}
+	updates := startUpdateCheck(opts)
+
+	var profileEnv map[string]string
+	if isProfileRef(remoteName) {
+		var err error
+		opts, remoteName, command, profileEnv, err = resolveProfile(cfg, remoteName, os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := setupRunner(opts); err != nil {
 		log.Fatal(err)
 	}
 
-	if err := runRemoteCommand(remote, command); err != nil {
+	if opts.CommandFile != "" {
+		if len(command) > 0 {
+			log.Fatal("give either a command or --command-file, not both")
+		}
+		if _, err := loadCommandFile(opts.CommandFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opts.Local && len(command) == 0 && opts.CommandFile == "" {
+		log.Fatal("--local needs a command to run")
+	}
+	if opts.Watch && len(command) == 0 && opts.CommandFile == "" && opts.WatchCommand == "" {
+		log.Fatal("--watch needs a command to run")
+	}
+	if opts.Jobs < 0 {
+		log.Fatal("--jobs must be at least 1")
+	}
+	if opts.FailFast && opts.KeepGoing {
+		log.Fatal("--fail-fast and --keep-going contradict each other")
+	}
+	if opts.WatchRestart && !opts.Watch {
+		log.Fatal("--watch-restart needs --watch")
+	}
+	if opts.WatchCommand != "" && !opts.Watch {
+		log.Fatal("--watch-command needs --watch")
+	}
+	if opts.WatchEvents != "" && !opts.Watch {
+		log.Fatal("--watch-events needs --watch")
+	}
+	names, err := expandRemoteNames(cfg, remoteName)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if opts.Watch && len(names) > 1 {
+		log.Fatal("--watch works with a single remote")
+	}
+
+	var remotes []Remote
+	for _, name := range names {
+		remote, err := resolveRemote(cfg, name, opts, profileEnv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		remotes = append(remotes, remote)
+	}
+	if len(remotes) > 1 {
+		// Each remote pulls into a directory of its own, so the same
+		// artifact built on two remotes doesn't land on one path. A remote
+		// with its own artifacts_dir already has one.
+		for i := range remotes {
+			if remotes[i].sharedArtifacts {
+				remotes[i].ArtifactsDir = filepath.Join(remotes[i].ArtifactsDir, remotes[i].name)
+			}
+		}
+	}
+
+	if err := checkToolVersions(opts, remotes); err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.Plan && !opts.Explain && !opts.EmitRsync {
+		if err := printPlan(remotes, opts, command, proj); err != nil {
+			log.Fatal(err)
+		}
+		if err := confirmPlan(opts); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Ctrl-C or SIGTERM cancels ctx, which interrupts the running rsync or
+	// ssh and lets buildon report and clean up instead of dying mid-step.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ok := true
+	switch {
+	case opts.Explain:
+		path, _ := configPath()
+		for _, remote := range remotes {
+			explainRemote(remote.name, remote, path)
+		}
+	case opts.EmitRsync:
+		for _, remote := range remotes {
+			if err := emitRsync(remote, opts); err != nil {
+				log.Fatal(err)
+			}
+		}
+	case len(remotes) > 1:
+		if len(command) == 0 && opts.CommandFile == "" {
+			log.Fatal("a command is required when running on several remotes")
+		}
+		if err := runProjectHook(ctx, "pre_sync", proj.PreSync, opts); err != nil {
+			log.Fatal(err)
+		}
+		if ok = runFanout(ctx, remotes, opts, command); ok {
+			if err := runProjectHook(ctx, "post_run", proj.PostRun, opts); err != nil {
+				log.Fatal(err)
+			}
+		}
+	case opts.Watch:
+		if err := runWatch(ctx, remotes[0], opts, command, proj); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		if err := runProjectHook(ctx, "pre_sync", proj.PreSync, opts); err != nil {
+			log.Fatal(err)
+		}
+		err := syncAndRun(ctx, remotes[0], opts, command)
+		if err == nil {
+			err = runProjectHook(ctx, "post_run", proj.PostRun, opts)
+		}
+		if err != nil {
+			if code := exitCode(err); opts.Local && code > 0 {
+				finishRunner()
+				os.Exit(code)
+			}
+			log.Fatal(err)
+		}
+	}
+
+	closeNativeClients()
+	if err := finishRunner(); err != nil {
+		log.Fatal(err)
+	}
+	reportUpdate(updates)
+	if !ok {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		defaults []string
+		remote   string
+		command  []string
+		dryRun   bool
+		timeout  time.Duration
+		append   bool
+	}{
+		{
+			name:    "flags before the remote",
+			args:    []string{"--dry-run", "dev", "make"},
+			remote:  "dev",
+			command: []string{"make"},
+			dryRun:  true,
+		},
+		{
+			name:    "flags after the remote",
+			args:    []string{"dev", "--dry-run", "make"},
+			remote:  "dev",
+			command: []string{"make"},
+			dryRun:  true,
+		},
+		{
+			name:    "flags on both sides",
+			args:    []string{"--timeout", "5s", "dev", "--dry-run", "make", "test"},
+			remote:  "dev",
+			command: []string{"make", "test"},
+			dryRun:  true,
+			timeout: 5 * time.Second,
+		},
+		{
+			name:    "double dash ends the flags",
+			args:    []string{"dev", "--", "--dry-run", "x"},
+			remote:  "dev",
+			command: []string{"--dry-run", "x"},
+		},
+		{
+			name:    "double dash right after the remote",
+			args:    []string{"dev", "--", "make"},
+			remote:  "dev",
+			command: []string{"make"},
+		},
+		{
+			name:    "command keeps its own flags",
+			args:    []string{"dev", "make", "-j4", "--dry-run"},
+			remote:  "dev",
+			command: []string{"make", "-j4", "--dry-run"},
+		},
+		{
+			name:   "no command opens a shell",
+			args:   []string{"--dry-run", "dev"},
+			remote: "dev",
+			dryRun: true,
+		},
+		{
+			name:     "command line overrides profile flags",
+			args:     []string{"--timeout", "5s", ":ci"},
+			defaults: []string{"--timeout", "1m", "--append"},
+			remote:   ":ci",
+			timeout:  5 * time.Second,
+			append:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, remote, command := parseArgsWithDefaults(tt.args, tt.defaults, nil)
+			if remote != tt.remote {
+				t.Errorf("remote = %q, want %q", remote, tt.remote)
+			}
+			if len(command) == 0 {
+				command = nil
+			}
+			if !reflect.DeepEqual(command, tt.command) {
+				t.Errorf("command = %q, want %q", command, tt.command)
+			}
+			if opts.DryRun != tt.dryRun {
+				t.Errorf("DryRun = %v, want %v", opts.DryRun, tt.dryRun)
+			}
+			if opts.Timeout != tt.timeout {
+				t.Errorf("Timeout = %v, want %v", opts.Timeout, tt.timeout)
+			}
+			if opts.Append != tt.append {
+				t.Errorf("Append = %v, want %v", opts.Append, tt.append)
+			}
+		})
+	}
+}
+
+func TestParseArgsRemoteOptional(t *testing.T) {
+	cfg := Config{Remote: map[string]Remote{"dev": {}}}
+	tests := []struct {
+		name    string
+		args    []string
+		remote  string
+		command []string
+		dryRun  bool
+	}{
+		{
+			name:   "no arguments",
+			args:   []string{"--dry-run"},
+			dryRun: true,
+		},
+		{
+			name:    "a remote",
+			args:    []string{"--dry-run", "dev", "make"},
+			remote:  "dev",
+			command: []string{"make"},
+			dryRun:  true,
+		},
+		{
+			name:    "a command",
+			args:    []string{"make", "test"},
+			command: []string{"make", "test"},
+		},
+		{
+			name:    "a command keeps flags after it",
+			args:    []string{"--dry-run", "make", "--dry-run", "test"},
+			command: []string{"make", "--dry-run", "test"},
+			dryRun:  true,
+		},
+		{
+			name:    "a group is never a command",
+			args:    []string{"@missing", "make"},
+			remote:  "@missing",
+			command: []string{"make"},
+		},
+		{
+			name:   "a profile is never a command",
+			args:   []string{":missing"},
+			remote: ":missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, remote, command := parseArgs(tt.args, cfg.isTarget)
+			if remote != tt.remote {
+				t.Errorf("remote = %q, want %q", remote, tt.remote)
+			}
+			if len(command) == 0 {
+				command = nil
+			}
+			if !reflect.DeepEqual(command, tt.command) {
+				t.Errorf("command = %q, want %q", command, tt.command)
+			}
+			if opts.DryRun != tt.dryRun {
+				t.Errorf("DryRun = %v, want %v", opts.DryRun, tt.dryRun)
+			}
+		})
+	}
+}
+
+// splitRsyncShell splits an -e value the way rsync does: on spaces, with
+// single and double quotes grouping and adjacent pieces joining.
+func splitRsyncShell(s string) []string {
+	var words []string
+	var word []rune
+	inWord := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word = append(word, r)
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ':
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = nil, false
+			}
+		default:
+			word, inWord = append(word, r), true
+		}
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+func TestRsyncQuote(t *testing.T) {
+	for _, s := range []string{
+		"-p",
+		"ProxyCommand=ssh -W %h:%p bastion",
+		"RemoteCommand=echo 'hi'",
+		`RemoteCommand=echo "hi"`,
+		`RemoteCommand=echo "it's"`,
+		"",
+	} {
+		got := splitRsyncShell("ssh " + rsyncQuote(s))
+		if want := []string{"ssh", s}; !reflect.DeepEqual(got, want) {
+			t.Errorf("rsyncQuote(%q) splits to %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,775 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// transportNative is the transport value that syncs and runs commands over
+// buildon's own ssh connection instead of the rsync and ssh binaries.
+const transportNative = "native"
+
+// nativeMarker is written into the remote path with each native sync. It
+// holds the manifest's id, so a path that was wiped, or synced from another
+// machine, isn't mistaken for one holding what the manifest says.
+const nativeMarker = ".buildon-native"
+
+// validateTransport checks the remote's transport, and that a native one
+// isn't combined with settings only rsync or the ssh binary understand, or
+// with the flags that need a pty or signal the remote process group.
+func validateTransport(remote Remote, opts Options) error {
+	switch remote.Transport {
+	case "", "exec":
+		return nil
+	case transportNative:
+	default:
+		return fmt.Errorf("transport: %q is not \"exec\" or %q", remote.Transport, transportNative)
+	}
+
+	var unsupported []string
+	for _, s := range []struct {
+		name string
+		set  bool
+	}{
+		{`shell = "powershell"`, remote.Shell == "powershell"},
+		{"ssh_config", remote.SSHConfig != ""},
+		{"ssh_options", len(remote.SSHOptions) > 0},
+		{"filter_file", remote.FilterFile != ""},
+		{"compress_choice", remote.CompressChoice != ""},
+		{"--rsync-path", opts.RsyncPath != ""},
+		{"--append", opts.Append || opts.AppendVerify},
+		{"--hard-links", opts.HardLinks},
+		{"--prune-empty-dirs", opts.PruneEmptyDirs},
+		{"--by-commit", opts.ByCommit},
+		{"--extra-source", len(opts.ExtraSources) > 0},
+		{"--interactive", opts.Interactive},
+		{"--timeout", opts.Timeout > 0},
+		{"--watch-restart", opts.WatchRestart},
+	} {
+		if s.set {
+			unsupported = append(unsupported, s.name)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("transport = %q doesn't support %s", transportNative, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// nativeClients holds one connection per user@host:port for the whole run,
+// so the sync and the command share it.
+var nativeClients = struct {
+	sync.Mutex
+	m map[string]*ssh.Client
+}{m: map[string]*ssh.Client{}}
+
+func nativeAddr(remote Remote) string {
+	port := remote.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(remote.Host, strconv.Itoa(port))
+}
+
+// nativeClient returns the connection to remote, dialling it the first time.
+func nativeClient(ctx context.Context, remote Remote) (*ssh.Client, error) {
+	addr := nativeAddr(remote)
+	key := remote.User + "@" + addr
+	nativeClients.Lock()
+	client, ok := nativeClients.m[key]
+	nativeClients.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	config, err := nativeConfig(remote, addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp"+remote.ipFamily, addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	// The handshake has no context of its own, so closing the connection is
+	// what stops it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	client = ssh.NewClient(c, chans, reqs)
+
+	nativeClients.Lock()
+	defer nativeClients.Unlock()
+	if other, ok := nativeClients.m[key]; ok {
+		// Another remote in a multi-remote run dialled the same host first.
+		client.Close()
+		return other, nil
+	}
+	nativeClients.m[key] = client
+	return client, nil
+}
+
+// closeNativeClients closes the connections nativeClient opened.
+func closeNativeClients() {
+	nativeClients.Lock()
+	defer nativeClients.Unlock()
+	for key, client := range nativeClients.m {
+		client.Close()
+		delete(nativeClients.m, key)
+	}
+}
+
+// nativeConfig authenticates like ssh does by default: with the keys in the
+// agent at $SSH_AUTH_SOCK, then with identity_file, or the usual keys under
+// ~/.ssh when it isn't set. Host keys are checked against
+// ~/.ssh/known_hosts; unknown hosts are refused rather than added.
+func nativeConfig(remote Remote, addr string) (*ssh.ClientConfig, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home dir: %w", err)
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("transport = %q needs ~/.ssh/known_hosts: %w", transportNative, err)
+	}
+
+	var auth []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	keyFiles := []string{remote.IdentityFile}
+	if remote.IdentityFile == "" {
+		keyFiles = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range keyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if remote.IdentityFile != "" {
+				return nil, fmt.Errorf("identity_file %s: %w", file, err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			// Left to the agent, which can hold the decrypted key.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no ssh agent or unencrypted key to log in to %s with", remote.Host)
+	}
+
+	return &ssh.ClientConfig{
+		User:              remote.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: knownHostAlgorithms(hostKeys, addr),
+	}, nil
+}
+
+// knownHostAlgorithms lists the host key algorithms known_hosts has keys
+// for at addr, so the server is asked for one of those instead of whichever
+// it prefers. It is nil, for the defaults, when the host isn't known.
+func knownHostAlgorithms(hostKeys ssh.HostKeyCallback, addr string) []string {
+	// Checking a key the file can't contain makes the callback list the
+	// keys it does have for addr.
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(hostKeys(addr, &net.TCPAddr{}, probe), &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, k := range keyErr.Want {
+		switch t := k.Key.Type(); t {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, t)
+		}
+	}
+	return algos
+}
+
+// nativeFile is what the manifest records about one synced file.
+type nativeFile struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"` // in nanoseconds
+	Mode    os.FileMode `json:"mode"`
+	SHA256  string      `json:"sha256"`
+}
+
+// nativeManifest is what native syncs have put in one remote path, keyed by
+// file. ID is also in the remote path's nativeMarker.
+type nativeManifest struct {
+	ID    string                `json:"id"`
+	Files map[string]nativeFile `json:"files"`
+}
+
+// nativeManifests are cached under ~/.cache/buildon/<host>/native.json,
+// keyed by remote path, so "buildon clean" forgets them with the rest of the
+// host's state.
+type nativeManifests map[string]nativeManifest
+
+func nativeManifestFile(remote Remote) (string, error) {
+	dir, err := hostCacheDir(remote.Host)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "native.json"), nil
+}
+
+func loadNativeManifests(remote Remote) nativeManifests {
+	manifests := nativeManifests{}
+	file, err := nativeManifestFile(remote)
+	if err != nil {
+		return manifests
+	}
+	if data, err := os.ReadFile(file); err == nil {
+		json.Unmarshal(data, &manifests)
+	}
+	return manifests
+}
+
+func saveNativeManifest(remote Remote, m nativeManifest) error {
+	file, err := nativeManifestFile(remote)
+	if err != nil {
+		return err
+	}
+	manifests := loadNativeManifests(remote)
+	manifests[remote.Path] = m
+	data, err := json.Marshal(manifests)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0o644)
+}
+
+// nativeState describes f as the manifest records it, hashing it only when
+// its size, mtime or mode differ from prev.
+func nativeState(f string, prev nativeFile, known bool) (nativeFile, error) {
+	info, err := os.Lstat(f)
+	if err != nil {
+		return nativeFile{}, err
+	}
+	st := nativeFile{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Mode: info.Mode()}
+	if known && st.Size == prev.Size && st.ModTime == prev.ModTime && st.Mode == prev.Mode {
+		st.SHA256 = prev.SHA256
+		return st, nil
+	}
+
+	h := sha256.New()
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(f)
+		if err != nil {
+			return nativeFile{}, err
+		}
+		io.WriteString(h, target)
+	} else {
+		file, err := os.Open(f)
+		if err != nil {
+			return nativeFile{}, err
+		}
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return nativeFile{}, err
+		}
+	}
+	st.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return st, nil
+}
+
+// nativeSync is rsyncToRemote for transport = "native": it sends the files
+// that changed since the manifest of the last native sync to the remote
+// path over SFTP on the remote's connection, and returns every selected
+// file.
+func nativeSync(ctx context.Context, remote Remote, opts Options) ([]string, error) {
+	files, untracked, err := selectFiles(fileSelection(remote, opts))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUntracked(remote, untracked, opts.Includes); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(remote.stdout(), "==> Nothing to sync (file list is empty).")
+		return nil, nil
+	}
+
+	var sc *sftp.Client
+	var prev nativeManifest
+	if !ignoreCaches(opts) {
+		prev = loadNativeManifests(remote)[remote.Path]
+	}
+	if !opts.DryRun {
+		if sc, err = nativeSFTP(ctx, remote); err != nil {
+			return nil, err
+		}
+		defer sc.Close()
+		stop := context.AfterFunc(ctx, func() { sc.Close() })
+		defer stop()
+		if prev.ID != "" && nativeMarkerID(sc, remote) != prev.ID {
+			prev = nativeManifest{}
+		}
+	}
+
+	next := nativeManifest{ID: prev.ID, Files: map[string]nativeFile{}}
+	if next.ID == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		next.ID = hex.EncodeToString(b)
+	}
+	for f, st := range prev.Files {
+		next.Files[f] = st
+	}
+	var changed []string
+	for _, f := range files {
+		old, known := prev.Files[f]
+		st, err := nativeState(f, old, known)
+		if err != nil {
+			return nil, err
+		}
+		if !known || st.SHA256 != old.SHA256 || st.Mode != old.Mode {
+			changed = append(changed, f)
+		}
+		next.Files[f] = st
+	}
+
+	fmt.Fprintf(remote.stdout(), "==> Syncing via native transport (%d of %d file(s) changed)...\n", len(changed), len(files))
+	if len(changed) > 0 {
+		fmt.Fprintln(remote.stdout(), "==> Files to sync:")
+		for _, f := range changed {
+			fmt.Fprintln(remote.stdout(), f)
+		}
+	}
+	if opts.DryRun {
+		return files, nil
+	}
+
+	if len(changed) > 0 {
+		if err := nativeUpload(ctx, sc, remote, changed, next.ID); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+	}
+	if remote.events != nil {
+		for _, f := range changed {
+			action := "updated"
+			if _, known := prev.Files[f]; !known {
+				action = "created"
+			}
+			remote.events.change(remote, f, action, "")
+		}
+	}
+	if err := saveNativeManifest(remote, next); err != nil {
+		fmt.Fprintf(remote.stderr(), "warning: save native manifest: %v\n", err)
+	}
+	return files, applyChmodMap(ctx, remote, files)
+}
+
+// nativeSFTP opens an SFTP session on remote's connection.
+func nativeSFTP(ctx context.Context, remote Remote) (*sftp.Client, error) {
+	client, err := nativeClient(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("start sftp on %s: %w", remote.Host, err)
+	}
+	return sc, nil
+}
+
+// nativeMarkerID returns the id in the remote path's nativeMarker, or ""
+// when there isn't one.
+func nativeMarkerID(sc *sftp.Client, remote Remote) string {
+	f, err := sc.Open(path.Join(remote.Path, nativeMarker))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	id, _ := io.ReadAll(io.LimitReader(f, 64))
+	return strings.TrimSpace(string(id))
+}
+
+// nativeUpload creates the remote path and copies files into it over SFTP,
+// then writes the marker holding id. The path is created by the remote
+// shell, which understands path_mode's symbolic modes.
+func nativeUpload(ctx context.Context, sc *sftp.Client, remote Remote, files []string, id string) error {
+	if err := runNativeSession(ctx, remote, mkdirPOSIX(remote), nil, remote.stdout(), remote.stderr()); err != nil {
+		return fmt.Errorf("create %s: %w", remote.Path, err)
+	}
+	made := map[string]bool{path.Clean(remote.Path): true}
+	for _, f := range files {
+		if err := nativePut(sc, remote.Path, f, made); err != nil {
+			return fmt.Errorf("upload %s: %w", f, err)
+		}
+	}
+
+	marker, err := sc.Create(path.Join(remote.Path, nativeMarker))
+	if err != nil {
+		return fmt.Errorf("write %s: %w", nativeMarker, err)
+	}
+	if _, err := io.WriteString(marker, id+"\n"); err != nil {
+		marker.Close()
+		return fmt.Errorf("write %s: %w", nativeMarker, err)
+	}
+	return marker.Close()
+}
+
+// nativePut copies the local file f to the same path under root, with its
+// mode and mtime. made records the remote directories known to exist.
+func nativePut(sc *sftp.Client, root, f string, made map[string]bool) error {
+	info, err := os.Lstat(f)
+	if err != nil {
+		return err
+	}
+	dst := path.Join(root, filepath.ToSlash(f))
+	if dir := path.Dir(dst); !made[dir] {
+		if err := sc.MkdirAll(dir); err != nil {
+			return err
+		}
+		made[dir] = true
+	}
+	// Removed first, so a symlink is replaced rather than written through,
+	// and a binary that is running on the remote can still be replaced.
+	sc.Remove(dst)
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(f)
+		if err != nil {
+			return err
+		}
+		return sc.Symlink(target, dst)
+	}
+	src, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := sc.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := out.ReadFrom(src); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := sc.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return sc.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// nativePull copies matches, paths in the remote path, into
+// remote.ArtifactsDir over SFTP, keeping their paths, modes and mtimes.
+// Directories are copied whole.
+func nativePull(ctx context.Context, remote Remote, matches []string) error {
+	sc, err := nativeSFTP(ctx, remote)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	stop := context.AfterFunc(ctx, func() { sc.Close() })
+	defer stop()
+
+	for _, m := range matches {
+		top := path.Join(remote.Path, m)
+		for walk := sc.Walk(top); walk.Step(); {
+			if err := walk.Err(); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+			rel := path.Join(m, strings.TrimPrefix(walk.Path(), top))
+			if err := nativeGet(sc, walk.Path(), walk.Stat(), filepath.Join(remote.ArtifactsDir, filepath.FromSlash(rel))); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		}
+	}
+	return nil
+}
+
+// nativeGet copies the remote file src, described by info, to dst.
+func nativeGet(sc *sftp.Client, src string, info os.FileInfo, dst string) error {
+	if info.IsDir() {
+		return os.MkdirAll(dst, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	os.Remove(dst)
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := sc.ReadLink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+	in, err := sc.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := in.WriteTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// runNativeCommand is runRemoteCommand for transport = "native".
+func runNativeCommand(ctx context.Context, remote Remote, cmdStr string) error {
+	return runNativeSession(ctx, remote, cmdStr, remote.stdin(), remote.stdout(), remote.stderr())
+}
+
+// runNativeSession runs cmdStr in a new session of remote's connection.
+// Cancelling ctx interrupts the command, like Ctrl-C over ssh would, and
+// closes the session if it is still running cancelGrace later. The
+// terminal's stdin is shared with other sessions through nativeStdin.
+func runNativeSession(ctx context.Context, remote Remote, cmdStr string, stdin io.Reader, stdout, stderr io.Writer) error {
+	client, err := nativeClient(ctx, remote)
+	if err != nil {
+		return err
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+	var pipe io.WriteCloser
+	switch {
+	case stdin == nil:
+	case stdin == os.Stdin:
+		// Copied outside the session, whose Wait would otherwise also wait
+		// for stdin to reach EOF.
+		if pipe, err = sess.StdinPipe(); err != nil {
+			return err
+		}
+	default:
+		sess.Stdin = stdin
+	}
+	if err := sess.Start(cmdStr); err != nil {
+		return err
+	}
+	if pipe != nil {
+		ended, copied := make(chan struct{}), make(chan struct{})
+		go func() {
+			copyNativeStdin(pipe, nativeInput(stdin), ended)
+			close(copied)
+		}()
+		// Waited for, so nothing from this session is left copying once
+		// the next one starts.
+		defer func() {
+			close(ended)
+			sess.Close()
+			<-copied
+		}()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sess.Wait() }()
+	select {
+	case err := <-done:
+		return nativeExitError(err)
+	case <-ctx.Done():
+	}
+	sess.Signal(ssh.SIGINT)
+	select {
+	case <-done:
+	case <-time.After(cancelGrace):
+		sess.Close()
+		<-done
+	}
+	return ctx.Err()
+}
+
+// runRemoteCmd runs c, an ssh command from sshCommandContext, with runCmd.
+// For a native remote its remote command line runs over the native
+// connection instead, with c's stdin and output.
+func runRemoteCmd(ctx context.Context, remote Remote, c *exec.Cmd) error {
+	if remote.Transport != transportNative {
+		return runCmd(c)
+	}
+	return runNativeSession(ctx, remote, c.Args[len(c.Args)-1], c.Stdin, c.Stdout, c.Stderr)
+}
+
+// outputRemoteCmd is runRemoteCmd returning c's stdout, like outputCmd.
+func outputRemoteCmd(ctx context.Context, remote Remote, c *exec.Cmd) ([]byte, error) {
+	if remote.Transport != transportNative {
+		return outputCmd(c)
+	}
+	var out bytes.Buffer
+	err := runNativeSession(ctx, remote, c.Args[len(c.Args)-1], c.Stdin, &out, c.Stderr)
+	return out.Bytes(), err
+}
+
+// nativeStdin holds what is read from the terminal's stdin for native
+// sessions. One goroutine reads it for the whole run, and each session
+// copies from it only while it runs, so input typed after one command ends
+// goes to the next.
+var nativeStdin struct {
+	sync.Mutex
+	chunks  chan []byte // closed at EOF
+	pending []byte      // read while a session was ending, for the next one
+}
+
+// nativeInput returns the chunks read from in, starting the reader the
+// first time.
+func nativeInput(in io.Reader) <-chan []byte {
+	nativeStdin.Lock()
+	defer nativeStdin.Unlock()
+	if nativeStdin.chunks == nil {
+		chunks := make(chan []byte)
+		nativeStdin.chunks = chunks
+		go func() {
+			defer close(chunks)
+			for {
+				buf := make([]byte, 32*1024)
+				n, err := in.Read(buf)
+				if n > 0 {
+					chunks <- buf[:n]
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	return nativeStdin.chunks
+}
+
+// copyNativeStdin writes chunks to a session's stdin until ended is closed,
+// or until they run out, closing stdin at EOF like the ssh binary does. A
+// chunk the session didn't take is kept for the next one.
+func copyNativeStdin(stdin io.WriteCloser, chunks <-chan []byte, ended <-chan struct{}) {
+	defer stdin.Close()
+	nativeStdin.Lock()
+	chunk := nativeStdin.pending
+	nativeStdin.pending = nil
+	nativeStdin.Unlock()
+	keep := func() {
+		nativeStdin.Lock()
+		nativeStdin.pending = chunk
+		nativeStdin.Unlock()
+	}
+
+	for {
+		if chunk != nil {
+			if _, err := stdin.Write(chunk); err != nil {
+				keep()
+				return
+			}
+		}
+		var ok bool
+		select {
+		case chunk, ok = <-chunks:
+			if !ok {
+				return
+			}
+		case <-ended:
+			return
+		}
+		// Both may have been ready, so check ended again.
+		select {
+		case <-ended:
+			keep()
+			return
+		default:
+		}
+	}
+}
+
+// nativeExitError words a remote exit status like the ssh binary's would be.
+func nativeExitError(err error) error {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("exit status %d", exitErr.ExitStatus())
+	}
+	return err
+}
+
+// nativeCommand reports whether runRemoteCommand runs command over the
+// native connection, returning the command line the remote shell gets.
+func nativeCommand(remote Remote, command []string) (bool, string) {
+	if remote.Transport != transportNative {
+		return false, ""
+	}
+	args := commandArgs(remote, command)
+	return true, args[len(args)-1]
+}
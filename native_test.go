@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshServer starts an ssh server on localhost that runs exec requests with
+// sh, serves SFTP, and accepts only the key it writes to
+// $HOME/.ssh/id_ed25519. Its host key goes into $HOME/.ssh/known_hosts, with
+// HOME pointed at a temp dir.
+func sshServer(t *testing.T) (host string, port int) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_ed25519"), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	allowed, _ := ssh.NewPublicKey(clientPub)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), allowed.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr.String())}, hostKey.PublicKey())
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeNativeClients)
+	return addr.IP.String(), addr.Port
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSession(ch, reqs)
+	}
+}
+
+func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	var cmd *exec.Cmd
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+			// Copied by hand so that, like sshd, the exit status doesn't
+			// wait for the client to close stdin.
+			stdin, _ := cmd.StdinPipe()
+			if err := cmd.Start(); err != nil {
+				req.Reply(false, nil)
+				ch.Close()
+				return
+			}
+			req.Reply(true, nil)
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+			go func() {
+				cmd.Wait()
+				status := struct{ Status uint32 }{uint32(cmd.ProcessState.ExitCode())}
+				ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+				ch.Close()
+			}()
+		case "subsystem":
+			var payload struct{ Name string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				server.Serve()
+				ch.Close()
+			}()
+		case "signal":
+			// Killed rather than interrupted, since the test may run with
+			// SIGINT ignored, which sh would pass on.
+			var payload struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if cmd != nil && cmd.Process != nil && payload.Signal == string(ssh.SIGINT) {
+				cmd.Process.Kill()
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func TestNativeSync(t *testing.T) {
+	host, port := sshServer(t)
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "remote")
+	t.Chdir(src)
+	for name, data := range map[string]string{"a.txt": "a\n", "sub/b.txt": "b\n"} {
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a.txt", "link"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &lockedBuffer{}
+	remote := Remote{Host: host, Port: port, User: "u", Path: dst, Transport: transportNative, out: out, errOut: out, detached: true}
+	opts := Options{NoGit: true}
+	sync := func(wantChanged string) {
+		t.Helper()
+		out.Reset()
+		if _, err := nativeSync(context.Background(), remote, opts); err != nil {
+			t.Fatalf("nativeSync: %v\n%s", err, out.String())
+		}
+		if want := "(" + wantChanged + " file(s) changed)"; !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't say %q:\n%s", want, out.String())
+		}
+	}
+
+	sync("3 of 3")
+	if data, _ := os.ReadFile(filepath.Join(dst, "sub/b.txt")); string(data) != "b\n" {
+		t.Errorf("remote sub/b.txt = %q, want %q", data, "b\n")
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "a.txt" {
+		t.Errorf("remote link -> %q (%v), want a.txt", target, err)
+	}
+
+	sync("0 of 3")
+
+	later := time.Now().Add(time.Minute)
+	os.WriteFile("sub/b.txt", []byte("changed\n"), 0o644)
+	os.Chtimes("sub/b.txt", later, later)
+	sync("1 of 3")
+	if data, _ := os.ReadFile(filepath.Join(dst, "sub/b.txt")); string(data) != "changed\n" {
+		t.Errorf("remote sub/b.txt = %q after a change, want %q", data, "changed\n")
+	}
+
+	// A wiped remote path no longer matches the manifest.
+	if err := os.RemoveAll(dst); err != nil {
+		t.Fatal(err)
+	}
+	sync("3 of 3")
+}
+
+func TestNativeCommand(t *testing.T) {
+	host, port := sshServer(t)
+	out := &lockedBuffer{}
+	remote := Remote{Host: host, Port: port, User: "u", Path: t.TempDir(), Transport: transportNative, out: out, errOut: out, detached: true}
+
+	if err := runNativeCommand(context.Background(), remote, "echo hi"); err != nil || out.String() != "hi\n" {
+		t.Errorf("echo hi: err %v, output %q", err, out.String())
+	}
+	if err := runNativeCommand(context.Background(), remote, "exit 3"); err == nil || err.Error() != "exit status 3" {
+		t.Errorf("exit 3: err %v, want exit status 3", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := runNativeCommand(ctx, remote, "exec sleep 30")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled sleep: err %v, want %v", err, context.DeadlineExceeded)
+	}
+	if took := time.Since(start); took > cancelGrace {
+		t.Errorf("cancelled sleep took %v, want it interrupted", took)
+	}
+}
+
+func TestNativeRemoteSteps(t *testing.T) {
+	host, port := sshServer(t)
+	dst := t.TempDir()
+	t.Chdir(t.TempDir())
+	out := &lockedBuffer{}
+	remote := Remote{
+		Host: host, Port: port, User: "u", Path: dst, Transport: transportNative, out: out, errOut: out, detached: true,
+		Bootstrap:    "echo deps > deps.txt",
+		ChmodMap:     map[string]string{"*.sh": "0700"},
+		Artifacts:    []string{"bin/tool", "dist/"},
+		ArtifactsDir: "out",
+	}
+
+	if err := runBootstrap(context.Background(), remote); err != nil {
+		t.Fatalf("bootstrap: %v\n%s", err, out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dst, bootstrapMarker)); err != nil {
+		t.Errorf("bootstrap left no marker: %v", err)
+	}
+
+	os.WriteFile(filepath.Join(dst, "run.sh"), nil, 0o644)
+	if err := applyChmodMap(context.Background(), remote, []string{"run.sh"}); err != nil {
+		t.Fatalf("chmod_map: %v\n%s", err, out.String())
+	}
+	if info, err := os.Stat(filepath.Join(dst, "run.sh")); err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("run.sh after chmod_map: %v, %v; want mode 0700", info, err)
+	}
+
+	os.MkdirAll(filepath.Join(dst, "bin"), 0o755)
+	os.MkdirAll(filepath.Join(dst, "dist", "css"), 0o755)
+	os.WriteFile(filepath.Join(dst, "bin", "tool"), []byte("tool\n"), 0o755)
+	os.WriteFile(filepath.Join(dst, "dist", "css", "site.css"), []byte("css\n"), 0o644)
+	if err := pullArtifacts(context.Background(), remote, Options{}); err != nil {
+		t.Fatalf("pullArtifacts: %v\n%s", err, out.String())
+	}
+	if info, err := os.Stat("out/bin/tool"); err != nil || info.Mode().Perm() != 0o755 {
+		t.Errorf("out/bin/tool: %v, %v; want it pulled with mode 0755", info, err)
+	}
+	if data, _ := os.ReadFile("out/dist/css/site.css"); string(data) != "css\n" {
+		t.Errorf("out/dist/css/site.css = %q, want the whole directory pulled", data)
+	}
+
+	err := runOneCommand(context.Background(), remote, Options{}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "can't open an interactive shell") {
+		t.Errorf("interactive shell: err %v, want it refused", err)
+	}
+}
+
+func TestValidateTransport(t *testing.T) {
+	for _, tt := range []struct {
+		remote Remote
+		opts   Options
+		err    string
+	}{
+		{remote: Remote{}},
+		{remote: Remote{Transport: "exec", SSHOptions: []string{"A=b"}}},
+		{remote: Remote{Transport: transportNative}},
+		{remote: Remote{Transport: "scp"}, err: `transport: "scp" is not "exec" or "native"`},
+		{remote: Remote{Transport: transportNative, Shell: "powershell", SSHOptions: []string{"A=b"}}, err: `doesn't support shell = "powershell", ssh_options`},
+		{remote: Remote{Transport: transportNative}, opts: Options{AppendVerify: true}, err: "doesn't support --append"},
+		{remote: Remote{Transport: transportNative}, opts: Options{Timeout: time.Minute, WatchRestart: true}, err: "doesn't support --timeout, --watch-restart"},
+	} {
+		err := validateTransport(tt.remote, tt.opts)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("validateTransport(%+v, %+v) = %v, want %s", tt.remote, tt.opts, err, strconv.Quote(tt.err))
+		}
+	}
+}
+
+func TestNativeStdinShared(t *testing.T) {
+	host, port := sshServer(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		w.Close()
+		nativeStdin.chunks = nil
+	})
+
+	out := &lockedBuffer{}
+	remote := Remote{Host: host, Port: port, User: "u", Path: t.TempDir(), Transport: transportNative, out: out, errOut: out}
+	// A command that never reads its stdin shouldn't leave anything behind
+	// to take the next one's.
+	for range 3 {
+		if err := runNativeCommand(context.Background(), remote, "true"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.WriteString("typed\n")
+	w.Close()
+	if err := runNativeCommand(context.Background(), remote, "cat"); err != nil || out.String() != "typed\n" {
+		t.Errorf("cat: err %v, output %q, want the input typed after the earlier commands", err, out.String())
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pathCacheTTL is how long a remote path is trusted to exist after buildon
+// last saw it there.
+const pathCacheTTL = 24 * time.Hour
+
+// knownPaths records remote paths buildon has recently ensured exist, keyed
+// by path. It is cached under ~/.cache/buildon/<host>/paths.json, so
+// "buildon clean" forgets it along with the rest of the host's state.
+type knownPaths map[string]time.Time
+
+func pathCacheFile(remote Remote) (string, error) {
+	dir, err := hostCacheDir(remote.Host)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "paths.json"), nil
+}
+
+func loadKnownPaths(remote Remote) knownPaths {
+	paths := knownPaths{}
+	file, err := pathCacheFile(remote)
+	if err != nil {
+		return paths
+	}
+	if data, err := os.ReadFile(file); err == nil {
+		json.Unmarshal(data, &paths)
+	}
+	return paths
+}
+
+// remotePathKnown reports whether the remote path was recently seen to
+// exist, so commands can skip creating it.
+func remotePathKnown(remote Remote) bool {
+	seen, ok := loadKnownPaths(remote)[remote.Path]
+	return ok && time.Since(seen) < pathCacheTTL
+}
+
+// rememberRemotePath records that the remote path exists. The cache is only
+// an optimisation, so failing to write it is not an error.
+func rememberRemotePath(remote Remote) {
+	file, err := pathCacheFile(remote)
+	if err != nil {
+		return
+	}
+	paths := loadKnownPaths(remote)
+	paths[remote.Path] = time.Now()
+	data, err := json.MarshalIndent(paths, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err == nil {
+		os.Rename(tmp, file)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// mkdirPOSIX creates the remote path, with PathMode when one is set. Like
+// mkdir -m itself, the mode only applies to the last component, and only
+// when it is created.
+func mkdirPOSIX(remote Remote) string {
+	p := shellQuotePOSIX(remote.Path)
+	if remote.PathMode == "" {
+		return "mkdir -p " + p
+	}
+	return fmt.Sprintf("mkdir -p -m %s %s", remote.PathMode, p)
+}
+
+// createRemotePath creates the remote path with PathMode before the first
+// sync to it, since rsync would otherwise create it with default
+// permissions. Paths the cache knows exist are left as they are, except
+// under --record/--replay.
+func createRemotePath(ctx context.Context, remote Remote, opts Options) error {
+	if remote.PathMode == "" || opts.DryRun || (!ignoreCaches(opts) && remotePathKnown(remote)) {
+		return nil
+	}
+	if remote.Shell == "powershell" {
+		fmt.Fprintln(remote.stdout(), "==> Ignoring path_mode: not supported for powershell remotes (set an ACL on the directory instead).")
+		return nil
+	}
+
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+	c := sshCommandContext(ctx, remote, target, mkdirPOSIX(remote))
+	c.Stdout = remote.stdout()
+	c.Stderr = remote.stderr()
+	if err := runCmd(c); err != nil {
+		return fmt.Errorf("create %s with mode %s on %s: %w", remote.Path, remote.PathMode, target, err)
+	}
+	return nil
+}
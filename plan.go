@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// printPlan describes what a run will do on each remote, before anything is
+// synced or run: where it syncs, how many files, and which commands run.
+func printPlan(remotes []Remote, opts Options, command []string, proj Project) error {
+	fmt.Println("==> Plan:")
+	if proj.PreSync != "" {
+		fmt.Printf("  first:     %s (pre_sync, locally)\n", proj.PreSync)
+	}
+	for _, remote := range remotes {
+		sel := fileSelection(remote, opts)
+		sel.debug = nil
+		files, untracked, err := selectFiles(sel)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("  %s (%s@%s:%s)\n", remote.name, remote.User, remote.Host, remote.Path)
+		if remote.PreSyncRemote != "" {
+			fmt.Printf("    check:   %s\n", remote.PreSyncRemote)
+		}
+		fmt.Printf("    sync:    %d file(s), %d untracked", len(files), len(untracked))
+		if remote.FilterFile != "" {
+			fmt.Printf(", filtered by %s", remote.FilterFile)
+		}
+		fmt.Println()
+		for _, src := range opts.ExtraSources {
+			fmt.Printf("    sync:    %s\n", src)
+		}
+		fmt.Println("    delete:  nothing (buildon never deletes remote files)")
+		if remote.Bootstrap != "" {
+			fmt.Printf("    once:    %s (bootstrap, unless already done)\n", remote.Bootstrap)
+		}
+
+		where := "run:  "
+		if opts.Local {
+			where = "local:"
+		}
+		switch {
+		case opts.CommandFile != "":
+			lines, err := loadCommandFile(opts.CommandFile)
+			if err != nil {
+				return err
+			}
+			for _, cl := range lines {
+				fmt.Printf("    %s   %s\n", where, strings.TrimSpace(cl.Directive+" "+cl.Command))
+			}
+		case len(command) == 0:
+			fmt.Println("    shell:   interactive, in the remote path")
+		default:
+			fmt.Printf("    %s   %s\n", where, strings.Join(command, " "))
+		}
+		if remote.PostRunRemote != "" && !opts.Local && (len(command) > 0 || opts.CommandFile != "") {
+			fmt.Printf("    then:    %s (post_run_remote)\n", remote.PostRunRemote)
+		}
+		if len(remote.Artifacts) > 0 && !opts.Local && (len(command) > 0 || opts.CommandFile != "") {
+			fmt.Printf("    pull:    %s into %s\n", strings.Join(remote.Artifacts, " "), remote.ArtifactsDir)
+		}
+	}
+	if proj.PostRun != "" {
+		fmt.Printf("  last:      %s (post_run, locally)\n", proj.PostRun)
+	}
+	return nil
+}
+
+// confirmPlan asks whether to go ahead with the printed plan. Without a
+// terminal to ask on, --yes is required.
+func confirmPlan(opts Options) error {
+	if opts.Yes {
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		return errors.New("--plan needs --yes when stdin isn't a terminal")
+	}
+	fmt.Print("Proceed? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return errors.New("aborted")
+	}
+	return nil
+}
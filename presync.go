@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// runPreSyncRemote runs the remote's PreSyncRemote guard, failing when it
+// exits nonzero so nothing is synced. It runs in the remote path if that
+// exists yet, otherwise in the login directory.
+func runPreSyncRemote(ctx context.Context, remote Remote, opts Options) error {
+	if remote.PreSyncRemote == "" {
+		return nil
+	}
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+	if opts.DryRun {
+		fmt.Fprintf(remote.stdout(), "==> Would run pre-sync check on %s: %s\n", target, remote.PreSyncRemote)
+		return nil
+	}
+
+	var sshArgs []string
+	if remote.Shell == "powershell" {
+		ps := fmt.Sprintf(
+			`$p=%s; if (Test-Path $p) { Set-Location -Path $p }; %s$global:LASTEXITCODE=0; %s; `+
+				`if (-not $? -or $LASTEXITCODE -ne 0) { exit 1 }`,
+			quotePS(remote.Path), envPS(remote.Env), remote.PreSyncRemote,
+		)
+		sshArgs = []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
+	} else {
+		cmdStr := fmt.Sprintf("cd %s 2>/dev/null; %s%s",
+			shellQuotePOSIX(remote.Path), envPOSIX(remote.Env), remote.PreSyncRemote)
+		sshArgs = []string{target, cmdStr}
+	}
+
+	fmt.Fprintf(remote.stdout(), "==> Running pre-sync check on %s: %s\n", target, strings.TrimSpace(remote.PreSyncRemote))
+	c := sshCommandContext(ctx, remote, sshArgs...)
+	c.Stdin = remote.stdin()
+	c.Stdout = remote.stdout()
+	c.Stderr = remote.stderr()
+	if err := runRemoteCmd(ctx, remote, c); err != nil {
+		return fmt.Errorf("pre_sync_remote failed on %s, not syncing: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile bundles a remote with flags, env and a command so a whole workflow
+// can be invoked as "buildon :<name>".
+type Profile struct {
+	Remote  string
+	Flags   []string
+	Env     map[string]string
+	Command string
+}
+
+// isProfileRef reports whether a remote-name argument refers to a profile.
+func isProfileRef(name string) bool {
+	return strings.HasPrefix(name, ":")
+}
+
+// resolveProfile expands a ":name" invocation. Profile flags are parsed
+// before the command-line ones so anything given on the command line wins,
+// and a command on the command line replaces the profile's command. Profile
+// env is layered over the remote's env.
+func resolveProfile(cfg Config, ref string, args []string) (Options, string, []string, map[string]string, error) {
+	name := strings.TrimPrefix(ref, ":")
+	profile, ok := cfg.Profile[name]
+	if !ok {
+		return Options{}, "", nil, nil, fmt.Errorf("no profile named %s", name)
+	}
+	if profile.Remote == "" {
+		return Options{}, "", nil, nil, fmt.Errorf("profile %s has no remote", name)
+	}
+
+	opts, _, command := parseArgsWithDefaults(args, profile.Flags, isProfileRef)
+	if len(command) == 0 && profile.Command != "" {
+		command = []string{profile.Command}
+	}
+	return opts, profile.Remote, command, profile.Env, nil
+}
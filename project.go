@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+// projectFileName is the per-project config, looked up in the repository
+// root (or the current directory outside a repository).
+const projectFileName = "buildon.toml"
+
+// Project is a repository's buildon.toml. Its remote, profile and group
+// tables are merged over the global config key by key; the other settings
+// apply to every remote used from the project.
+type Project struct {
+	// DefaultRemote is used when no remote is given, and DefaultCommand is
+	// run when neither a remote nor a command is given.
+	DefaultRemote  string `toml:"default_remote"`
+	DefaultCommand string `toml:"default_command"`
+
+	// Subpath is appended to every remote's path, so each project gets its
+	// own directory.
+	Subpath string
+
+	// Env is set in the remote session, over the remote's own env.
+	Env map[string]string
+
+	// Exclude keeps matching files out of the sync; Include adds files or
+	// directories git doesn't list, such as ignored generated files.
+	// Both are relative to the project directory.
+	Exclude []string
+	Include []string
+
+	// PreSync and PostRun run locally in the project directory, before the
+	// first sync and after every remote's command succeeded. PreSyncRemote
+	// and PostRunRemote are the remote defaults for remotes that don't set
+	// their own.
+	PreSync       string `toml:"pre_sync"`
+	PostRun       string `toml:"post_run"`
+	PreSyncRemote string `toml:"pre_sync_remote"`
+	PostRunRemote string `toml:"post_run_remote"`
+
+	path string // of the buildon.toml, or "" when there is none
+	tree *toml.Tree
+}
+
+// projectDir is where the project file is looked up: the repository root,
+// or the current directory outside a repository.
+func projectDir() string {
+	if root, err := outputCmd(exec.Command("git", "rev-parse", "--show-toplevel")); err == nil {
+		return strings.TrimSpace(string(root))
+	}
+	return "."
+}
+
+// loadProject reads the project's buildon.toml, if it has one.
+func loadProject() Project {
+	p := filepath.Join(projectDir(), projectFileName)
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return Project{}
+	}
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", p, err)
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		log.Fatalf("failed to parse %s: %v", p, err)
+	}
+	var proj Project
+	if err := tree.Unmarshal(&proj); err != nil {
+		log.Fatalf("failed to parse %s: %v", p, err)
+	}
+	proj.path, proj.tree = p, tree
+
+	if err := validateSubpath(proj.Subpath); err != nil {
+		log.Fatalf("%s: %v", p, err)
+	}
+	return proj
+}
+
+func validateSubpath(sub string) error {
+	if sub == "" {
+		return nil
+	}
+	clean := path.Clean(filepath.ToSlash(sub))
+	if path.IsAbs(clean) || filepath.IsAbs(sub) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("subpath %q: must be a relative directory inside the remote path", sub)
+	}
+	return nil
+}
+
+// mergeProject copies the project's remote, profile and group settings over
+// tree, one key at a time, so a project can override a single setting of a
+// remote defined globally. Tables such as env and chmod_map are merged key
+// by key too, rather than replaced.
+func mergeProject(tree *toml.Tree, proj Project) {
+	if proj.tree == nil {
+		return
+	}
+	for _, table := range []string{"remote", "profile", "group"} {
+		sub, ok := proj.tree.Get(table).(*toml.Tree)
+		if !ok {
+			continue
+		}
+		for _, name := range sub.Keys() {
+			if entry, ok := sub.GetPath([]string{name}).(*toml.Tree); ok {
+				mergeTree(tree, entry, []string{table, name})
+			}
+		}
+	}
+}
+
+// mergeTree sets each key of src in tree under prefix, descending into
+// src's sub-tables.
+func mergeTree(tree, src *toml.Tree, prefix []string) {
+	for _, key := range src.Keys() {
+		path := append(prefix[:len(prefix):len(prefix)], key)
+		value := src.GetPath([]string{key})
+		if sub, ok := value.(*toml.Tree); ok {
+			mergeTree(tree, sub, path)
+			continue
+		}
+		tree.SetPath(path, value)
+	}
+}
+
+// applyProject applies the project-wide settings to a remote.
+func applyProject(remote Remote, proj Project) Remote {
+	if proj.path == "" {
+		return remote
+	}
+	if len(proj.Env) > 0 {
+		remote.Env = mergeEnv(remote.Env, proj.Env)
+		remote.setSource("env", proj.path)
+	}
+	if proj.Subpath != "" {
+		remote.Path = path.Join(filepath.ToSlash(remote.Path), filepath.ToSlash(proj.Subpath))
+		remote.setSource("path", proj.path+" subpath")
+	}
+	if remote.PreSyncRemote == "" && proj.PreSyncRemote != "" {
+		remote.PreSyncRemote = proj.PreSyncRemote
+		remote.setSource("pre_sync_remote", proj.path)
+	}
+	if remote.PostRunRemote == "" && proj.PostRunRemote != "" {
+		remote.PostRunRemote = proj.PostRunRemote
+		remote.setSource("post_run_remote", proj.path)
+	}
+	remote.excludes = proj.relPaths(proj.Exclude, true)
+	remote.extraPaths = proj.relPaths(proj.Include, false)
+	return remote
+}
+
+// relPaths turns paths relative to the project directory into paths
+// relative to the current directory, which is what the sync uses. With
+// patterns set, those without a slash match a base name anywhere and are
+// kept as they are. Paths outside the current directory are dropped, since
+// they aren't synced from here.
+func (proj Project) relPaths(paths []string, patterns bool) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return paths
+	}
+	dir, err := filepath.Abs(filepath.Dir(proj.path))
+	if err != nil {
+		return paths
+	}
+	var out []string
+	for _, p := range paths {
+		trimmed := strings.TrimSuffix(p, "/")
+		if patterns && !strings.Contains(trimmed, "/") {
+			out = append(out, p)
+			continue
+		}
+		rel, err := filepath.Rel(cwd, filepath.Join(dir, filepath.FromSlash(trimmed)))
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if trimmed != p {
+			rel += "/"
+		}
+		out = append(out, rel)
+	}
+	return out
+}
+
+// runProjectHook runs the project's pre_sync or post_run command locally,
+// in the project directory, like --local does.
+func runProjectHook(ctx context.Context, name, command string, opts Options) error {
+	if command == "" {
+		return nil
+	}
+	if opts.DryRun {
+		fmt.Printf("==> Would run %s locally: %s\n", name, command)
+		return nil
+	}
+
+	fmt.Printf("==> Running %s: %s\n", name, command)
+	c := localCommand(ctx, []string{command})
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := runCmd(c); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
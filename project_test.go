@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pelletier/go-toml"
+)
+
+func TestMergeProject(t *testing.T) {
+	global, err := toml.Load(`
+[remote.linux]
+host = "build.example.com"
+path = "src"
+
+[remote.linux.env]
+GLOBAL = "1"
+SHARED = "global"
+
+[remote.linux.chmod_map]
+"*.sh" = "0755"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, err := toml.Load(`
+[remote.linux]
+path = "src/app"
+
+[remote.linux.env]
+PROJECT = "1"
+SHARED = "project"
+
+[remote.linux.chmod_map]
+"bin/*" = "0700"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mergeProject(global, Project{tree: project})
+	var cfg Config
+	if err := global.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	remote := cfg.Remote["linux"]
+	if remote.Host != "build.example.com" || remote.Path != "src/app" {
+		t.Errorf("host, path = %q, %q; want the global host and the project's path", remote.Host, remote.Path)
+	}
+	for k, want := range map[string]string{"GLOBAL": "1", "PROJECT": "1", "SHARED": "project"} {
+		if got := remote.Env[k]; got != want {
+			t.Errorf("env %s = %q, want %q (env: %v)", k, got, want, remote.Env)
+		}
+	}
+	if len(remote.ChmodMap) != 2 || remote.ChmodMap["*.sh"] != "0755" || remote.ChmodMap["bin/*"] != "0700" {
+		t.Errorf("chmod_map = %v, want both configs' patterns", remote.ChmodMap)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// remoteTmp returns the remote scratch directory for transient state buildon
+// keeps while it works. It defaults to a sibling of the remote path, so it
+// stays on the same filesystem without being synced into.
+func remoteTmp(remote Remote) string {
+	if remote.RemoteTmp != "" {
+		return remote.RemoteTmp
+	}
+	p := strings.TrimSuffix(remote.Path, "/")
+	if p == "" || p == "." {
+		return ".buildon-tmp"
+	}
+	return path.Join(path.Dir(p), "."+path.Base(p)+".buildon-tmp")
+}
+
+// checkRemoteTmp is a preflight for features that need remote scratch space:
+// it creates the directory and fails clearly if it isn't writable.
+func checkRemoteTmp(ctx context.Context, remote Remote) error {
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+	dir := remoteTmp(remote)
+
+	var sshArgs []string
+	if remote.Shell == "powershell" {
+		ps := fmt.Sprintf(
+			`$t=%s; New-Item -ItemType Directory -Force -Path $t *> $null; $f=Join-Path $t '.buildon-write-test'; `+
+				`try { New-Item -ItemType File -Force -Path $f -ErrorAction Stop *> $null; Remove-Item $f } catch { exit 1 }`,
+			quotePS(dir),
+		)
+		sshArgs = []string{target, "powershell", "-NoProfile", "-NoLogo", "-Command", ps}
+	} else {
+		cmdStr := fmt.Sprintf("mkdir -p %s && test -w %s", shellQuotePOSIX(dir), shellQuotePOSIX(dir))
+		sshArgs = []string{target, cmdStr}
+	}
+
+	c := sshCommandContext(ctx, remote, sshArgs...)
+	c.Stderr = remote.stderr()
+	if err := runCmd(c); err != nil {
+		return fmt.Errorf("remote_tmp %s is not writable on %s (set remote_tmp to a writable directory)", dir, target)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// rsyncExitCodes explains rsync's exit statuses, from rsync(1).
+var rsyncExitCodes = map[int]string{
+	1:  "syntax or usage error",
+	2:  "protocol incompatibility",
+	3:  "errors selecting input/output files or dirs",
+	4:  "requested action not supported by the remote rsync",
+	5:  "error starting client-server protocol",
+	6:  "daemon unable to append to log file",
+	10: "error in socket I/O",
+	11: "error in file I/O",
+	12: "error in rsync protocol data stream",
+	13: "errors with program diagnostics",
+	14: "error in IPC code",
+	20: "interrupted by a signal",
+	21: "some error returned by waitpid()",
+	22: "error allocating core memory buffers",
+	23: "partial transfer: some files could not be transferred",
+	24: "some source files vanished during transfer",
+	25: "--max-delete limit stopped deletions",
+	30: "timeout in data send/receive",
+	35: "timeout waiting for daemon connection",
+}
+
+// benignRsyncCodes are exit statuses that don't fail a sync. Files that
+// vanish mid-transfer are typically editor swap files or build outputs being
+// rewritten; whatever still exists was synced.
+var benignRsyncCodes = map[int]bool{24: true}
+
+// rsyncError turns the error from waiting on rsync into one that says what
+// its exit status means. It prints a warning to w and returns nil for
+// benign statuses.
+func rsyncError(w io.Writer, err error) error {
+	code := exitCode(err)
+	meaning, ok := rsyncExitCodes[code]
+	if !ok {
+		return err
+	}
+	if benignRsyncCodes[code] {
+		fmt.Fprintf(w, "==> Warning: rsync: %s (code %d)\n", meaning, code)
+		return nil
+	}
+	return fmt.Errorf("rsync: %s (code %d)", meaning, code)
+}
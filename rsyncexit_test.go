@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// exitWith returns the error from a process that exits with code.
+func exitWith(t *testing.T, code int) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	if exitCode(err) != code {
+		t.Fatalf("can't produce exit status %d: %v", code, err)
+	}
+	return err
+}
+
+func TestRsyncError(t *testing.T) {
+	t.Run("vanished files are a warning", func(t *testing.T) {
+		var w strings.Builder
+		if err := rsyncError(&w, exitWith(t, 24)); err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+		if !strings.Contains(w.String(), "vanished") || !strings.Contains(w.String(), "code 24") {
+			t.Errorf("warning = %q, want it to explain code 24", w.String())
+		}
+	})
+
+	t.Run("partial transfer is an error", func(t *testing.T) {
+		var w strings.Builder
+		err := rsyncError(&w, exitWith(t, 23))
+		if err == nil {
+			t.Fatal("got nil, want an error")
+		}
+		if !strings.Contains(err.Error(), "partial transfer") || !strings.Contains(err.Error(), "code 23") {
+			t.Errorf("error = %q, want it to explain code 23", err)
+		}
+		if w.Len() != 0 {
+			t.Errorf("printed %q for a failing status", w.String())
+		}
+	})
+
+	t.Run("unknown status is returned unchanged", func(t *testing.T) {
+		orig := exitWith(t, 42)
+		if err := rsyncError(&strings.Builder{}, orig); err != orig {
+			t.Errorf("got %v, want the original %v", err, orig)
+		}
+		other := errors.New("rsync not found")
+		if err := rsyncError(&strings.Builder{}, other); err != other {
+			t.Errorf("got %v, want the original %v", err, other)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		var w strings.Builder
+		if err := rsyncError(&w, nil); err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+		if w.Len() != 0 {
+			t.Errorf("printed %q for a successful run", w.String())
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandRunner is the seam every subprocess buildon spawns (git, rsync, ssh
+// and local hooks) goes through, so runs can be recorded and replayed.
+type CommandRunner interface {
+	Start(c *exec.Cmd) error
+	Wait(c *exec.Cmd) error
+}
+
+type execRunner struct{}
+
+func (execRunner) Start(c *exec.Cmd) error { return c.Start() }
+func (execRunner) Wait(c *exec.Cmd) error  { return c.Wait() }
+
+var runner CommandRunner = execRunner{}
+
+// runCmd is c.Run through the runner.
+func runCmd(c *exec.Cmd) error {
+	if err := runner.Start(c); err != nil {
+		return err
+	}
+	return runner.Wait(c)
+}
+
+// outputCmd is c.Output through the runner.
+func outputCmd(c *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	c.Stdout = &out
+	err := runCmd(c)
+	return out.Bytes(), err
+}
+
+// invocation is one recorded subprocess run.
+type invocation struct {
+	Seq      int       `json:"seq"`
+	Argv     []string  `json:"argv"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_ms"`
+	Exit     int       `json:"exit"`
+}
+
+var (
+	secretAssign = regexp.MustCompile(`(?i)\b(\w*(?:token|secret|passw(?:or)?d|key|auth|credential)\w*)=('[^']*'|"[^"]*"|\S+)`)
+	volatileArg  = regexp.MustCompile(`buildon-files-\d+\.txt|\.buildon-[0-9a-f]{12}\.pid`)
+)
+
+// redactArgv masks values assigned to secret-looking variables, as in the
+// env exports of a remote command.
+func redactArgv(argv []string) []string {
+	out := make([]string, len(argv))
+	for i, a := range argv {
+		out[i] = secretAssign.ReplaceAllString(a, "$1=***")
+	}
+	return out
+}
+
+// normalizeArgv replaces the parts of an argv that change from run to run,
+// such as temp file names, so replays can compare invocations.
+func normalizeArgv(argv []string) string {
+	return volatileArg.ReplaceAllString(strings.Join(redactArgv(argv), "\x00"), "<tmp>")
+}
+
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		return -1
+	}
+}
+
+// recordingRunner appends a JSON line per finished subprocess to a file.
+type recordingRunner struct {
+	inner CommandRunner
+	mu    sync.Mutex
+	f     *os.File
+	seq   int
+	start map[*exec.Cmd]invocation
+}
+
+func newRecordingRunner(inner CommandRunner, path string) (*recordingRunner, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("--record: %w", err)
+	}
+	return &recordingRunner{inner: inner, f: f, start: map[*exec.Cmd]invocation{}}, nil
+}
+
+func (r *recordingRunner) Start(c *exec.Cmd) error {
+	r.mu.Lock()
+	r.seq++
+	inv := invocation{Seq: r.seq, Argv: redactArgv(c.Args), Start: time.Now()}
+	r.mu.Unlock()
+
+	if err := r.inner.Start(c); err != nil {
+		inv.Exit = -1
+		r.write(inv)
+		return err
+	}
+	r.mu.Lock()
+	r.start[c] = inv
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *recordingRunner) Wait(c *exec.Cmd) error {
+	err := r.inner.Wait(c)
+	r.mu.Lock()
+	inv := r.start[c]
+	delete(r.start, c)
+	r.mu.Unlock()
+
+	inv.Duration = float64(time.Since(inv.Start).Microseconds()) / 1000
+	inv.Exit = exitCode(err)
+	r.write(inv)
+	return err
+}
+
+func (r *recordingRunner) write(inv invocation) {
+	data, _ := json.Marshal(inv)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Write(append(data, '\n'))
+}
+
+func (r *recordingRunner) finish() error {
+	return r.f.Close()
+}
+
+// replayRunner runs subprocesses normally but fails as soon as one differs
+// from the next invocation in a recording, and at the end if any recorded
+// invocation never happened.
+type replayRunner struct {
+	inner    CommandRunner
+	mu       sync.Mutex
+	expected []invocation
+	next     int
+}
+
+func newReplayRunner(inner CommandRunner, path string) (*replayRunner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("--replay: %w", err)
+	}
+	defer f.Close()
+
+	var expected []invocation
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var inv invocation
+		if err := json.Unmarshal(sc.Bytes(), &inv); err != nil {
+			return nil, fmt.Errorf("--replay %s: %w", path, err)
+		}
+		expected = append(expected, inv)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("--replay %s: %w", path, err)
+	}
+	// Lines are written as commands finish; replay in start order.
+	sort.Slice(expected, func(i, j int) bool { return expected[i].Seq < expected[j].Seq })
+	return &replayRunner{inner: inner, expected: expected}, nil
+}
+
+func (r *replayRunner) Start(c *exec.Cmd) error {
+	r.mu.Lock()
+	if r.next >= len(r.expected) {
+		r.mu.Unlock()
+		return fmt.Errorf("replay: unexpected invocation %s", shellJoin(redactArgv(c.Args)))
+	}
+	want := r.expected[r.next]
+	r.next++
+	r.mu.Unlock()
+
+	if normalizeArgv(c.Args) != normalizeArgv(want.Argv) {
+		return fmt.Errorf("replay: invocation %d differs\n  recorded: %s\n  got:      %s",
+			want.Seq, shellJoin(want.Argv), shellJoin(redactArgv(c.Args)))
+	}
+	return r.inner.Start(c)
+}
+
+func (r *replayRunner) Wait(c *exec.Cmd) error { return r.inner.Wait(c) }
+
+func (r *replayRunner) finish() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next < len(r.expected) {
+		return fmt.Errorf("replay: %d recorded invocation(s) did not happen, starting with %s",
+			len(r.expected)-r.next, shellJoin(r.expected[r.next].Argv))
+	}
+	return nil
+}
+
+// ignoreCaches reports whether local caches must not decide which commands
+// run. A recording has to replay the same invocations whatever the cache
+// holds on the replaying machine, so --record and --replay skip them.
+func ignoreCaches(opts Options) bool {
+	return opts.Record != "" || opts.Replay != ""
+}
+
+// setupRunner installs the recording or replaying runner requested by opts.
+func setupRunner(opts Options) error {
+	switch {
+	case opts.Record != "" && opts.Replay != "":
+		return errors.New("--record and --replay are mutually exclusive")
+	case opts.Record != "":
+		r, err := newRecordingRunner(runner, opts.Record)
+		if err != nil {
+			return err
+		}
+		runner = r
+	case opts.Replay != "":
+		r, err := newReplayRunner(runner, opts.Replay)
+		if err != nil {
+			return err
+		}
+		runner = r
+	}
+	return nil
+}
+
+// finishRunner flushes a recording or checks that a replay completed.
+func finishRunner() error {
+	if f, ok := runner.(interface{ finish() error }); ok {
+		return f.finish()
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// commandScript returns the repo-relative script a command runs, or "" when
+// it doesn't run one. Without force, only a first word starting with "./"
+// that names a local file counts.
+func commandScript(command []string, force bool) (string, error) {
+	if len(command) == 0 {
+		return "", nil
+	}
+	// Profile commands arrive as one string, so look at its first word.
+	fields := strings.Fields(command[0])
+	if len(fields) == 0 {
+		return "", nil
+	}
+	word := fields[0]
+	if !force && !strings.HasPrefix(word, "./") {
+		return "", nil
+	}
+
+	info, err := os.Stat(word)
+	if err != nil || info.IsDir() {
+		if force {
+			return "", fmt.Errorf("--script: %s is not a file in the repo", word)
+		}
+		return "", nil
+	}
+	return filepath.ToSlash(filepath.Clean(word)), nil
+}
+
+// prepareScript makes sure a script run by command was part of the sync and
+// is executable on the remote, so freshly synced scripts don't fail with
+// "permission denied". It returns the command to run.
+func prepareScript(remote Remote, command, synced []string, force bool) ([]string, error) {
+	script, err := commandScript(command, force)
+	if err != nil || script == "" {
+		return command, err
+	}
+
+	found := false
+	for _, f := range synced {
+		if f == script {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s was not synced (is it ignored by git or outside --pathspec?)", script)
+	}
+
+	if remote.Shell == "powershell" {
+		return command, nil
+	}
+	return append([]string{"chmod", "+x", shellQuotePOSIX(script), "&&"}, command...), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selection decides which local files are synced to a remote.
+type selection struct {
+	pathspecs []string
+	manifest  string   // sync exactly the files listed here
+	paths     []string // or just these, when --watch re-syncs what changed
+
+	noGit       bool // walk the directory instead of asking git
+	gitOptional bool // walk the directory when it isn't a git repository
+
+	// buildon.toml's exclude and include: patterns kept out of the sync,
+	// and files or directories added to it.
+	excludes, extra []string
+
+	debug io.Writer // where --debug-selection traces each decision, or nil
+
+	// direct runs git outside the command runner, so --watch polling isn't
+	// recorded.
+	direct bool
+}
+
+// gitRunner is the runner the selection's git commands go through.
+func (sel selection) gitRunner() CommandRunner {
+	if sel.direct {
+		return execRunner{}
+	}
+	return runner
+}
+
+func fileSelection(remote Remote, opts Options) selection {
+	sel := selection{
+		pathspecs:   opts.Pathspecs,
+		manifest:    opts.FromManifest,
+		noGit:       opts.NoGit,
+		gitOptional: !remote.GitRequired,
+		paths:       remote.syncOnly,
+		excludes:    remote.excludes,
+		extra:       remote.extraPaths,
+	}
+	if opts.DebugSelection {
+		sel.debug = remote.stderr()
+		if remote.FilterFile != "" {
+			fmt.Fprintf(sel.debug, "selection: rsync applies %s after this; use --dry-run to see what it sends\n", remote.FilterFile)
+		}
+	}
+	return sel
+}
+
+// trace records, for --debug-selection, what happened to file f found by
+// the from pass (tracked, untracked, walk or manifest).
+func (sel selection) trace(from, decision, f string) {
+	if sel.debug != nil {
+		fmt.Fprintf(sel.debug, "selection: %-9s %-20s %s\n", from, decision, f)
+	}
+}
+
+// walkFiles calls emit for every file under the current directory, skipping
+// .git directories. It is the selection used without git, so nothing is
+// ignored and nothing counts as untracked.
+func walkFiles(sel selection, emit func(f string, untracked bool) error) error {
+	if len(sel.pathspecs) > 0 {
+		return errors.New("--pathspec needs git (drop it, or run inside a git repository without --no-git)")
+	}
+	return filepath.WalkDir(".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				sel.trace("walk", "skip: git metadata", filepath.ToSlash(p)+"/")
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		f := filepath.ToSlash(p)
+		sel.trace("walk", "sync", f)
+		return emit(f, false)
+	})
+}
+
+// manifestFiles calls emit for each path listed in the --from-manifest file,
+// which holds one path per line or NUL-separated paths. Every listed path
+// must exist locally, so a stale manifest fails instead of syncing less than
+// it claims.
+func manifestFiles(sel selection, emit func(f string, untracked bool) error) error {
+	if len(sel.pathspecs) > 0 {
+		return errors.New("--pathspec can't be combined with --from-manifest")
+	}
+	data, err := os.ReadFile(sel.manifest)
+	if err != nil {
+		return fmt.Errorf("--from-manifest: %w", err)
+	}
+
+	sep := []byte("\n")
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = []byte{0}
+	}
+	var files, missing []string
+	for _, entry := range bytes.Split(data, sep) {
+		f := strings.TrimSuffix(string(entry), "\r")
+		if f == "" {
+			continue
+		}
+		if filepath.IsAbs(f) {
+			return fmt.Errorf("--from-manifest: %s: paths must be relative to the directory being synced", f)
+		}
+		if _, err := os.Lstat(f); err != nil {
+			sel.trace("manifest", "error: not on disk", f)
+			missing = append(missing, f)
+			continue
+		}
+		sel.trace("manifest", "sync", f)
+		files = append(files, f)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("--from-manifest: %d listed file(s) don't exist:\n  %s", len(missing), strings.Join(missing, "\n  "))
+	}
+
+	for _, f := range files {
+		if err := emit(f, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changedPathFiles calls emit for each of sel.paths that still exists, for
+// the incremental syncs of --watch. In a git repository, git says which of
+// them are untracked so untracked_policy still applies.
+func changedPathFiles(sel selection, emit func(f string, untracked bool) error) error {
+	untracked := map[string]bool{}
+	if !sel.noGit && len(sel.paths) > 0 && insideGitRepo(sel.gitRunner()) {
+		args := []string{"ls-files", "-z", "--others", "--exclude-standard", "--"}
+		for _, p := range sel.paths {
+			args = append(args, ":(literal)"+p)
+		}
+		err := gitStream(sel.gitRunner(), func(f string) error {
+			untracked[f] = true
+			return nil
+		}, args...)
+		if err != nil {
+			return fmt.Errorf("git ls-files --others failed: %w", err)
+		}
+	}
+
+	for _, f := range sel.paths {
+		if _, err := os.Lstat(f); err != nil {
+			sel.trace("changed", "skip: not on disk", f)
+			continue
+		}
+		sel.trace("changed", "sync", f)
+		if err := emit(f, untracked[f]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// projectFiles applies buildon.toml's exclude and include to the rest of
+// the selection. Included files count as tracked, so untracked_policy
+// doesn't flag them, and excludes win over includes. A --from-manifest list
+// or a --watch re-sync only has excludes applied.
+func projectFiles(sel selection, emit func(f string, untracked bool) error) error {
+	seen := map[string]bool{}
+	visit := func(from, f string, untracked bool) error {
+		if seen[f] {
+			return nil
+		}
+		seen[f] = true
+		if untrackedIncluded(f, sel.excludes) {
+			sel.trace(from, "skip: excluded", f)
+			return nil
+		}
+		return emit(f, untracked && !untrackedIncluded(f, sel.extra))
+	}
+
+	inner := sel
+	inner.excludes, inner.extra = nil, nil
+	err := streamFilesToSync(inner, func(f string, untracked bool) error {
+		return visit("project", f, untracked)
+	})
+	if err != nil || sel.manifest != "" || sel.paths != nil {
+		return err
+	}
+
+	for _, p := range sel.extra {
+		root := filepath.FromSlash(strings.TrimSuffix(p, "/"))
+		if _, err := os.Lstat(root); os.IsNotExist(err) {
+			sel.trace("include", "skip: not on disk", p)
+			continue
+		}
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			f := filepath.ToSlash(p)
+			if !seen[f] {
+				sel.trace("include", "sync", f)
+			}
+			return visit("include", f, false)
+		})
+		if err != nil {
+			return fmt.Errorf("include %s: %w", p, err)
+		}
+	}
+	return nil
+}
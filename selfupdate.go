@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// version is the running buildon's release, set at build time with
+// -ldflags "-X main.version=v1.2.3". Development builds never update.
+var version = "dev"
+
+const (
+	releasesURL = "https://api.github.com/repos/littledivy/buildon/releases/latest"
+
+	// updateCheckEvery is how often a normal run looks for a new release.
+	updateCheckEvery = 24 * time.Hour
+)
+
+// release is the part of GitHub's release API response buildon uses.
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r release) assetURL(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// releaseAsset is the name of the release binary for this platform.
+func releaseAsset() string {
+	name := fmt.Sprintf("buildon_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// newerThanRunning reports whether tag names a later release than version.
+func newerThanRunning(tag string) bool {
+	return version != "dev" && versionLess(strings.TrimPrefix(version, "v"), strings.TrimPrefix(tag, "v"))
+}
+
+func fetchLatestRelease(ctx context.Context) (release, error) {
+	var rel release
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releasesURL, nil)
+	if err != nil {
+		return rel, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return rel, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rel, fmt.Errorf("GET %s: %s", releasesURL, resp.Status)
+	}
+	return rel, json.NewDecoder(resp.Body).Decode(&rel)
+}
+
+func download(ctx context.Context, url string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// expectedChecksum finds asset's sha256 in a checksums.txt in sha256sum's
+// format.
+func expectedChecksum(sums, asset string) (string, error) {
+	for _, line := range strings.Split(sums, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == asset {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("checksums.txt has no entry for %s", asset)
+}
+
+// runSelfUpdate implements "buildon selfupdate": it replaces the running
+// binary with the latest release once the user confirms, after checking the
+// download against the release's checksums.txt.
+func runSelfUpdate(args []string) {
+	fs := flag.NewFlagSet("buildon selfupdate", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: buildon selfupdate [--yes]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if version == "dev" {
+		log.Fatal("this is a development build; install a release to use selfupdate")
+	}
+	ctx := context.Background()
+	rel, err := fetchLatestRelease(ctx)
+	if err != nil {
+		log.Fatalf("check for updates: %v", err)
+	}
+	if !newerThanRunning(rel.TagName) {
+		fmt.Printf("==> buildon %s is up to date.\n", version)
+		return
+	}
+
+	asset := releaseAsset()
+	binURL, ok := rel.assetURL(asset)
+	if !ok {
+		log.Fatalf("release %s has no %s binary", rel.TagName, asset)
+	}
+	sumsURL, ok := rel.assetURL("checksums.txt")
+	if !ok {
+		log.Fatalf("release %s has no checksums.txt; not installing an unverified binary", rel.TagName)
+	}
+
+	if !*yes {
+		fmt.Printf("Update buildon %s to %s? [y/N] ", version, rel.TagName)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("==> Not updating.")
+			return
+		}
+	}
+
+	if err := installRelease(ctx, binURL, sumsURL, asset); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("==> Updated buildon to %s.\n", rel.TagName)
+}
+
+// installRelease downloads the binary next to the running one, verifies it
+// and renames it into place, so a failure leaves the old binary untouched.
+func installRelease(ctx context.Context, binURL, sumsURL, asset string) error {
+	var sums strings.Builder
+	if err := download(ctx, sumsURL, &sums); err != nil {
+		return fmt.Errorf("download checksums: %w", err)
+	}
+	want, err := expectedChecksum(sums.String(), asset)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".buildon-update-*")
+	if err != nil {
+		return fmt.Errorf("can't write next to %s: %w", exe, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	err = download(ctx, binURL, io.MultiWriter(tmp, h))
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("download %s: %w", asset, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", asset, got, want)
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		// A running executable can't be replaced, only moved aside.
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// updateCheckDisabled reports whether the background release check is
+// turned off, by --no-update-check or BUILDON_NO_UPDATE_CHECK.
+func updateCheckDisabled(opts Options) bool {
+	return opts.NoUpdateCheck || os.Getenv("BUILDON_NO_UPDATE_CHECK") != "" || version == "dev"
+}
+
+// startUpdateCheck looks for a newer release in the background, at most once
+// per updateCheckEvery; the latest tag is remembered in between. The
+// returned channel receives the newer tag, if any. Network and cache errors
+// are ignored.
+func startUpdateCheck(opts Options) <-chan string {
+	found := make(chan string, 1)
+	if updateCheckDisabled(opts) {
+		return found
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return found
+	}
+	stamp := filepath.Join(dir, "update-check")
+	if info, err := os.Stat(stamp); err == nil && time.Since(info.ModTime()) < updateCheckEvery {
+		// Checked recently: keep reminding about what that check found.
+		if data, err := os.ReadFile(stamp); err == nil {
+			if tag := strings.TrimSpace(string(data)); newerThanRunning(tag) {
+				found <- tag
+			}
+		}
+		return found
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		rel, err := fetchLatestRelease(ctx)
+		if err != nil {
+			return
+		}
+		if os.MkdirAll(dir, 0o755) == nil {
+			os.WriteFile(stamp, []byte(rel.TagName+"\n"), 0o644)
+		}
+		if newerThanRunning(rel.TagName) {
+			found <- rel.TagName
+		}
+	}()
+	return found
+}
+
+// reportUpdate mentions a newer release if the background check has found
+// one by now. It never waits for the check.
+func reportUpdate(found <-chan string) {
+	select {
+	case tag := <-found:
+		fmt.Fprintf(os.Stderr, "==> buildon %s is available (you have %s); run buildon selfupdate\n", tag, version)
+	default:
+	}
+}
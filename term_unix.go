@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func isTerminal(f *os.File) bool {
+	_, ok := winsize(f)
+	return ok
+}
+
+// terminalWidth returns f's terminal width in columns, or 80 if unknown.
+func terminalWidth(f *os.File) int {
+	if ws, ok := winsize(f); ok && ws.Col > 0 {
+		return int(ws.Col)
+	}
+	return 80
+}
+
+type winsizeT struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+func winsize(f *os.File) (winsizeT, bool) {
+	var ws winsizeT
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	return ws, errno == 0
+}
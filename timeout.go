@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// killSignals are the signal names accepted by --kill-signal.
+var killSignals = []string{"TERM", "INT", "HUP", "QUIT", "KILL", "USR1", "USR2"}
+
+// parseKillSignal normalizes a signal name such as "sigint" to "INT".
+func parseKillSignal(name string) (string, error) {
+	sig := strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	for _, s := range killSignals {
+		if s == sig {
+			return sig, nil
+		}
+	}
+	return "", fmt.Errorf("--kill-signal: unknown signal %q (want one of %s)", name, strings.Join(killSignals, ", "))
+}
+
+// newPIDFile returns a unique name for the file in remote_tmp that records
+// the remote command's process group while it runs.
+func newPIDFile() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return ".buildon-" + hex.EncodeToString(b) + ".pid"
+}
+
+// signalRemote sends sig to the process group of the remote command that
+// recorded itself in remote.pidFile under remote_tmp. sshd starts each
+// command in its own session, so the group covers everything the command
+// spawned.
+func signalRemote(remote Remote, sig string) error {
+	target := fmt.Sprintf("%s@%s", remote.User, remote.Host)
+	cmdStr := fmt.Sprintf("cd %s && kill -s %s -- -$(cat %s)", shellQuotePOSIX(remoteTmp(remote)), sig, remote.pidFile)
+	c := sshCommand(remote, target, cmdStr)
+	c.Stderr = remote.stderr()
+	return runCmd(c)
+}
+
+// waitWithTimeout waits for the started ssh command c. If it outlives
+// opts.Timeout, or ctx is cancelled first, the remote command gets
+// opts.KillSignal, then KILL once opts.KillGrace has passed. PowerShell
+// remotes have no process groups to signal, so there the connection is
+// dropped instead, which ends the remote command because a pty was allocated
+// for it.
+func waitWithTimeout(ctx context.Context, remote Remote, opts Options, c *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() { done <- runner.Wait(c) }()
+
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timeout = time.After(opts.Timeout)
+	}
+
+	var reason string
+	var stopped error
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		reason = fmt.Sprintf("Timed out after %s", opts.Timeout)
+		stopped = fmt.Errorf("command timed out after %s", opts.Timeout)
+	case <-ctx.Done():
+		reason = "Interrupted"
+		stopped = fmt.Errorf("command interrupted: %w", ctx.Err())
+	}
+
+	if remote.pidFile == "" {
+		fmt.Fprintf(remote.stderr(), "==> %s; closing the connection\n", reason)
+		c.Process.Kill()
+		<-done
+		return stopped
+	}
+
+	fmt.Fprintf(remote.stderr(), "==> %s; sending SIG%s\n", reason, opts.KillSignal)
+	if err := signalRemote(remote, opts.KillSignal); err != nil {
+		fmt.Fprintf(remote.stderr(), "==> Failed to signal remote command: %v\n", err)
+	}
+	select {
+	case <-done:
+		return stopped
+	case <-time.After(opts.KillGrace):
+	}
+
+	fmt.Fprintf(remote.stderr(), "==> Still running after %s; sending SIGKILL\n", opts.KillGrace)
+	signalRemote(remote, "KILL")
+	c.Process.Kill()
+	<-done
+	return stopped
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tuiRefresh is how often the --tui table is redrawn.
+	tuiRefresh = 200 * time.Millisecond
+
+	// tuiTailLines is how much of each remote's output the dashboard
+	// keeps, to show after the run for remotes that failed.
+	tuiTailLines = 20
+)
+
+// tuiRow is the dashboard's view of one remote.
+type tuiRow struct {
+	name     string
+	status   string
+	started  time.Time
+	finished time.Time
+	tail     []string // last complete output lines
+	partial  []byte
+}
+
+// tui draws a live table of a multi-remote run, one row per remote,
+// redrawn in place. Remote output is kept off the terminal; each row shows
+// the remote's latest output line instead.
+type tui struct {
+	mu    sync.Mutex
+	rows  []tuiRow
+	drawn int // lines drawn last time, to move back over
+	width int
+
+	stop, stopped chan struct{}
+}
+
+// newTUI returns a dashboard for remotes, or nil when stdout isn't a
+// terminal, in which case the run falls back to line output.
+func newTUI(remotes []Remote) *tui {
+	if !isTerminal(os.Stdout) {
+		return nil
+	}
+	t := &tui{stop: make(chan struct{}), stopped: make(chan struct{})}
+	for _, r := range remotes {
+		t.rows = append(t.rows, tuiRow{name: r.name, status: "waiting"})
+	}
+	go t.loop()
+	return t
+}
+
+func (t *tui) loop() {
+	defer close(t.stopped)
+	tick := time.NewTicker(tuiRefresh)
+	defer tick.Stop()
+	for {
+		t.draw()
+		select {
+		case <-t.stop:
+			t.draw()
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Stop draws the final state and leaves the table on screen.
+func (t *tui) Stop() {
+	close(t.stop)
+	<-t.stopped
+}
+
+func (t *tui) setStatus(i int, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	row := &t.rows[i]
+	now := time.Now()
+	if row.started.IsZero() {
+		row.started = now
+	}
+	switch status {
+	case "ok", "skipped":
+		row.finished = now
+	default:
+		if strings.HasPrefix(status, "FAILED") {
+			row.finished = now
+		}
+	}
+	row.status = status
+}
+
+// writer returns an io.Writer collecting remote i's output for its row.
+func (t *tui) writer(i int) *tuiWriter {
+	return &tuiWriter{t: t, i: i}
+}
+
+type tuiWriter struct {
+	t *tui
+	i int
+}
+
+func (w *tuiWriter) Write(b []byte) (int, error) {
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
+	row := &w.t.rows[w.i]
+	row.partial = append(row.partial, b...)
+	for {
+		j := bytes.IndexAny(row.partial, "\r\n")
+		if j < 0 {
+			break
+		}
+		if line := strings.TrimSpace(string(row.partial[:j])); line != "" {
+			row.tail = append(row.tail, line)
+			if len(row.tail) > tuiTailLines {
+				row.tail = row.tail[len(row.tail)-tuiTailLines:]
+			}
+		}
+		row.partial = row.partial[j+1:]
+	}
+	return len(b), nil
+}
+
+// tail returns the last output lines of remote i.
+func (t *tui) tail(i int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{}, t.rows[i].tail...)
+}
+
+func (t *tui) draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	width := terminalWidth(os.Stdout)
+	var b strings.Builder
+	if t.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", t.drawn)
+	}
+	if width != t.width {
+		// After a resize, earlier rows may have wrapped; clear everything
+		// below the table's first line before redrawing.
+		b.WriteString("\x1b[J")
+		t.width = width
+	}
+
+	nameWidth := len("REMOTE")
+	for _, r := range t.rows {
+		nameWidth = max(nameWidth, len(r.name))
+	}
+	lines := []string{fmt.Sprintf("%-*s  %-16s  %7s  %s", nameWidth, "REMOTE", "STATUS", "TIME", "OUTPUT")}
+	for _, r := range t.rows {
+		elapsed := ""
+		if !r.started.IsZero() {
+			end := r.finished
+			if end.IsZero() {
+				end = time.Now()
+			}
+			elapsed = end.Sub(r.started).Round(100 * time.Millisecond).String()
+		}
+		last := ""
+		if len(r.tail) > 0 {
+			last = r.tail[len(r.tail)-1]
+		}
+		status := r.status
+		if len(status) > 16 {
+			status = status[:16]
+		}
+		lines = append(lines, fmt.Sprintf("%-*s  %-16s  %7s  %s", nameWidth, r.name, status, elapsed, last))
+	}
+	for _, line := range lines {
+		if len(line) > width-1 {
+			line = line[:width-1]
+		}
+		b.WriteString("\x1b[2K" + line + "\n")
+	}
+	t.drawn = len(lines)
+	os.Stdout.WriteString(b.String())
+}
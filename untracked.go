@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Untracked policies: whether untracked-but-not-ignored files are synced
+// silently, synced with a warning, or refuse the sync.
+const (
+	untrackedInclude = "include"
+	untrackedWarn    = "warn"
+	untrackedError   = "error"
+)
+
+func validateUntrackedPolicy(policy string) error {
+	switch policy {
+	case "", untrackedInclude, untrackedWarn, untrackedError:
+		return nil
+	}
+	return fmt.Errorf("untracked_policy: %q is not one of include, warn, error", policy)
+}
+
+// untrackedIncluded reports whether an untracked file was deliberately let
+// through with --include. Patterns match like chmod_map keys, or name a
+// directory whose contents are all included.
+func untrackedIncluded(f string, includes []string) bool {
+	for _, pattern := range includes {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if chmodMatch(pattern, f) || strings.HasPrefix(f, pattern+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUntracked applies the remote's untracked policy to the untracked
+// files selected for sync, ignoring those matched by an --include. Under
+// "error" it returns an error listing them; under "warn" it prints them.
+func checkUntracked(remote Remote, untracked, includes []string) error {
+	var flagged []string
+	for _, f := range untracked {
+		if !untrackedIncluded(f, includes) {
+			flagged = append(flagged, f)
+		}
+	}
+	if len(flagged) == 0 {
+		return nil
+	}
+
+	switch remote.UntrackedPolicy {
+	case untrackedError:
+		return fmt.Errorf("untracked_policy is error and %d untracked file(s) would be synced (commit them, ignore them, or pass --include):\n  %s",
+			len(flagged), strings.Join(flagged, "\n  "))
+	case untrackedWarn:
+		fmt.Fprintf(remote.stderr(), "==> Warning: synced %d untracked file(s) that are not committed:\n", len(flagged))
+		for _, f := range flagged {
+			fmt.Fprintf(remote.stderr(), "  %s\n", f)
+		}
+	}
+	return nil
+}
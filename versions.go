@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// toolRequirement records that a feature needs a minimum version of a local
+// tool. Active reports whether the current flags or remotes use the feature.
+type toolRequirement struct {
+	Feature string
+	Tool    string
+	Min     string
+	Active  func(Options, []Remote) bool
+}
+
+var toolRequirements = []toolRequirement{
+	{"--append-verify", "rsync", "3.0.0", func(o Options, _ []Remote) bool { return o.AppendVerify }},
+	{"--compress-choice", "rsync", "3.2.0", func(_ Options, remotes []Remote) bool {
+		for _, r := range remotes {
+			if r.CompressChoice != "" {
+				return true
+			}
+		}
+		return false
+	}},
+	{"--pathspec with magic signatures", "git", "1.9.0", func(o Options, _ []Remote) bool {
+		for _, p := range o.Pathspecs {
+			if strings.HasPrefix(p, ":(") {
+				return true
+			}
+		}
+		return false
+	}},
+}
+
+var versionRe = regexp.MustCompile(`version\s+v?(\d+(?:\.\d+)*)`)
+
+// toolVersion returns the version reported by "<tool> --version".
+func toolVersion(tool string) (string, error) {
+	out, err := outputCmd(exec.Command(tool, "--version"))
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %w", tool, err)
+	}
+	m := versionRe.FindSubmatch(out)
+	if m == nil {
+		return "", fmt.Errorf("%s --version: no version in %q", tool, strings.TrimSpace(string(out)))
+	}
+	return string(m[1]), nil
+}
+
+// versionLess compares dotted numeric versions.
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+// checkToolVersions fails with a "feature X requires tool >= Y" error when an
+// active feature needs a newer local git or rsync than is installed. Tools
+// are only queried for features that are in use.
+func checkToolVersions(opts Options, remotes []Remote) error {
+	versions := map[string]string{}
+	for _, req := range toolRequirements {
+		if !req.Active(opts, remotes) {
+			continue
+		}
+		v, ok := versions[req.Tool]
+		if !ok {
+			var err error
+			if v, err = toolVersion(req.Tool); err != nil {
+				return err
+			}
+			versions[req.Tool] = v
+		}
+		if versionLess(v, req.Min) {
+			return fmt.Errorf("%s requires %s >= %s, but %s is installed", req.Feature, req.Tool, req.Min, v)
+		}
+	}
+	for _, r := range remotes {
+		if r.CompressChoice != "" {
+			if err := checkCompressChoice(r.CompressChoice); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkCompressChoice fails unless the local rsync lists algo among the
+// compression algorithms it was built with.
+func checkCompressChoice(algo string) error {
+	out, err := outputCmd(exec.Command("rsync", "--version"))
+	if err != nil {
+		return fmt.Errorf("rsync --version: %w", err)
+	}
+	_, rest, ok := strings.Cut(string(out), "Compress list:")
+	if !ok {
+		// Older output formats don't list them; rsync itself will refuse
+		// an unknown choice.
+		return nil
+	}
+	list, _, _ := strings.Cut(strings.TrimLeft(rest, " \t\r\n"), "\n")
+	for _, a := range strings.Fields(list) {
+		if a == algo {
+			return nil
+		}
+	}
+	return fmt.Errorf("--compress-choice %s: local rsync only supports %s", algo, strings.Join(strings.Fields(list), ", "))
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// watchPoll is how often --watch looks for changed files.
+	watchPoll = 250 * time.Millisecond
+
+	// watchRescan is how often --watch asks git for the selection again, to
+	// notice new files; polls in between only stat the files already known.
+	watchRescan = 2 * time.Second
+
+	// watchDebounce is how long the tree has to stay unchanged before a
+	// change triggers a run, so a burst of saves syncs once.
+	watchDebounce = 300 * time.Millisecond
+)
+
+// fileState is what --watch compares to notice that a file changed.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watcher snapshots the files the selection would sync, so ignored files
+// never trigger a run.
+type watcher struct {
+	sel     selection
+	files   []string
+	scanned time.Time // when files was last listed, zero before the first time
+}
+
+// snapshot records the state of every known file, first listing the
+// selection again if it is older than watchRescan.
+func (w *watcher) snapshot() (map[string]fileState, error) {
+	if w.scanned.IsZero() || time.Since(w.scanned) >= watchRescan {
+		files, _, err := selectFiles(w.sel)
+		if err != nil {
+			return nil, err
+		}
+		w.files, w.scanned = files, time.Now()
+	}
+	snap := make(map[string]fileState, len(w.files))
+	for _, f := range w.files {
+		if info, err := os.Lstat(f); err == nil {
+			snap[f] = fileState{info.ModTime(), info.Size()}
+		}
+	}
+	return snap, nil
+}
+
+// changedFiles lists the files added, removed or modified between two
+// snapshots.
+func changedFiles(before, after map[string]fileState) []string {
+	var changed []string
+	for f, st := range after {
+		if prev, ok := before[f]; !ok || prev != st {
+			changed = append(changed, f)
+		}
+	}
+	for f := range before {
+		if _, ok := after[f]; !ok {
+			changed = append(changed, f)
+		}
+	}
+	return changed
+}
+
+// watchChanges polls the selection until ctx is done, sending the changed
+// files on the returned channel once they have settled for watchDebounce.
+// The channel holds one pending change set; changes that arrive while one is
+// still pending are merged into it rather than queued separately.
+func watchChanges(ctx context.Context, sel selection, errOut io.Writer) <-chan []string {
+	changes := make(chan []string, 1)
+	go func() {
+		w := &watcher{sel: sel}
+		prev, err := w.snapshot()
+		if err != nil {
+			fmt.Fprintf(errOut, "warning: watch: %v\n", err)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchPoll):
+			}
+			cur, err := w.snapshot()
+			if err != nil {
+				continue
+			}
+			changed := changedFiles(prev, cur)
+			if len(changed) == 0 {
+				continue
+			}
+
+			// Wait for the burst to end before reporting it.
+			for settled := false; !settled; {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchDebounce):
+				}
+				next, err := w.snapshot()
+				if err != nil {
+					continue
+				}
+				more := changedFiles(cur, next)
+				settled = len(more) == 0
+				changed = append(changed, more...)
+				cur = next
+			}
+			prev = cur
+
+			select {
+			case changes <- changed:
+			case pending := <-changes:
+				changes <- append(pending, changed...)
+			}
+		}
+	}()
+	return changes
+}
+
+// runWatch implements --watch: it syncs and runs command once, then again
+// each time a file in the synced set changes, until ctx is cancelled. Runs
+// after a change use --watch-command instead when it is given. After
+// the first run only the changed files are synced. A change during a run
+// queues exactly one follow-up run, or with --watch-restart stops the
+// running command and starts over straight away. The project's pre_sync and
+// post_run hooks run around every run. Failed runs are reported and
+// watching carries on; files a failed run didn't sync are synced by the next.
+// With --watch-events each sync's changes are also written as watchEvents.
+func runWatch(ctx context.Context, remote Remote, opts Options, command []string, proj Project) error {
+	if opts.WatchEvents != "" {
+		events, err := openEventLog(opts.WatchEvents)
+		if err != nil {
+			return err
+		}
+		defer events.Close()
+		remote.events = events
+	}
+	sel := fileSelection(remote, opts)
+	sel.debug = nil
+	sel.direct = true
+	changes := watchChanges(ctx, sel, remote.stderr())
+
+	// Runs after a change use --watch-command, in place of the command or
+	// --command-file.
+	rerunOpts, rerun := opts, command
+	if opts.WatchCommand != "" {
+		rerunOpts.CommandFile = ""
+		rerun = []string{opts.WatchCommand}
+	}
+	if len(command) == 0 && opts.CommandFile == "" {
+		opts, command = rerunOpts, rerun
+	}
+
+	synced := map[string]bool{} // everything sent to the remote so far
+	var changed []string        // nil syncs the whole selection
+	for first := true; ; first = false {
+		runOpts, runCommand := rerunOpts, rerun
+		if first {
+			runOpts, runCommand = opts, command
+		}
+
+		// Only --watch-restart listens for changes while a run is going.
+		var restart <-chan []string
+		if opts.WatchRestart {
+			restart = changes
+		}
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		sent := false // whether the run got its changes to the remote
+		go func() {
+			err := runProjectHook(runCtx, "pre_sync", proj.PreSync, runOpts)
+			if err == nil {
+				sent, err = watchRun(runCtx, remote, runOpts, runCommand, changed, synced)
+			}
+			if err == nil {
+				err = runProjectHook(runCtx, "post_run", proj.PostRun, runOpts)
+			}
+			done <- err
+		}()
+
+		var err error
+		restarted := false
+		select {
+		case err = <-done:
+		case more := <-restart:
+			describeChanges(remote, more)
+			fmt.Fprintln(remote.stdout(), "==> Restarting...")
+			cancel()
+			<-done
+			restarted = true
+			if changed != nil {
+				// The interrupted run may not have synced its changes yet.
+				changed = append(changed, more...)
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			fmt.Fprintln(remote.stdout(), "==> Stopped watching.")
+			return nil
+		}
+		if restarted {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(remote.stderr(), "==> failed: %v\n", err)
+		}
+		fmt.Fprintln(remote.stdout(), "==> Watching for changes (Ctrl-C to stop)...")
+
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(remote.stdout(), "==> Stopped watching.")
+			return nil
+		case more := <-changes:
+			describeChanges(remote, more)
+			switch {
+			case sent:
+				changed = more
+			case changed != nil:
+				// The failed run's changes never reached the remote. A
+				// failed full sync leaves changed nil, so it is retried.
+				changed = append(changed, more...)
+			}
+		}
+	}
+}
+
+// watchRun is one run of runWatch. With changed nil it syncs and runs as
+// usual; otherwise it syncs just the changed files that still exist and runs
+// against everything synced so far, which it records in synced. It reports
+// whether the sync succeeded, so a failed command isn't mistaken for changes
+// still to send.
+func watchRun(ctx context.Context, remote Remote, opts Options, command, changed []string, synced map[string]bool) (bool, error) {
+	if changed != nil {
+		var present []string
+		for _, f := range uniqueFiles(changed) {
+			if _, err := os.Lstat(f); err == nil {
+				present = append(present, f)
+			}
+		}
+		if len(present) == 0 {
+			// Only deletions, which buildon never syncs.
+			fmt.Fprintln(remote.stdout(), "==> Nothing to sync.")
+		}
+		remote.syncOnly = present
+	} else {
+		clear(synced)
+	}
+
+	var files []string
+	if changed == nil || len(remote.syncOnly) > 0 {
+		var err error
+		if files, err = syncRemote(ctx, remote, opts); err != nil {
+			return false, err
+		}
+		if remote.events != nil {
+			remote.events.synced(remote)
+		}
+	}
+	for _, f := range files {
+		synced[f] = true
+	}
+
+	all := make([]string, 0, len(synced))
+	for f := range synced {
+		all = append(all, f)
+	}
+	sort.Strings(all)
+	return true, runSynced(ctx, remote, opts, command, all)
+}
+
+func uniqueFiles(files []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, f := range files {
+		if !seen[f] {
+			seen[f] = true
+			unique = append(unique, f)
+		}
+	}
+	return unique
+}
+
+func describeChanges(remote Remote, changed []string) {
+	unique := uniqueFiles(changed)
+	if len(unique) == 1 {
+		fmt.Fprintf(remote.stdout(), "==> Changed: %s\n", unique[0])
+		return
+	}
+	fmt.Fprintf(remote.stdout(), "==> Changed: %s and %d more\n", unique[0], len(unique)-1)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that can be written from several goroutines,
+// like a session's stdout and stderr, while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// waitFor polls until cond holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, out *lockedBuffer, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for %s; output:\n%s", what, out.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWatchRetriesFailedSync(t *testing.T) {
+	host, port := sshServer(t)
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(name, []byte(name+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The remote path can't be created while a file is in the way.
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(blocker, "remote")
+
+	out := &lockedBuffer{}
+	remote := Remote{Host: host, Port: port, User: "u", Path: dst, Transport: transportNative, out: out, errOut: out, detached: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runWatch(ctx, remote, Options{NoGit: true}, []string{"true"}, Project{}) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "the first sync to fail", out, func() bool { return strings.Contains(out.String(), "==> failed:") })
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("a.txt", []byte("changed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a.txt changed, but the failed first sync means b.txt is still to
+	// be sent too.
+	waitFor(t, "the retried sync", out, func() bool {
+		_, err := os.Stat(filepath.Join(dst, "b.txt"))
+		return err == nil
+	})
+	if data, _ := os.ReadFile(filepath.Join(dst, "a.txt")); string(data) != "changed\n" {
+		t.Errorf("remote a.txt = %q, want %q", data, "changed\n")
+	}
+}
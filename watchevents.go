@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchEvent is one JSON line of --watch-events output. A "change" event
+// names one file a sync sent; a "synced" event follows the last change of a
+// sync.
+type watchEvent struct {
+	Event   string    `json:"event"` // "change" or "synced"
+	Time    time.Time `json:"time"`
+	Remote  string    `json:"remote"`
+	Path    string    `json:"path,omitempty"`
+	Action  string    `json:"action,omitempty"`  // "created" or "updated"
+	Itemize string    `json:"itemize,omitempty"` // rsync's --itemize-changes flags, as in "<f.st......"
+}
+
+// eventLog writes watchEvents as JSON lines, to a file or to stdout.
+type eventLog struct {
+	mu  sync.Mutex
+	f   *os.File // nil for stdout
+	enc *json.Encoder
+}
+
+// openEventLog opens the --watch-events destination; "-" is stdout.
+func openEventLog(path string) (*eventLog, error) {
+	if path == "-" {
+		return &eventLog{enc: json.NewEncoder(os.Stdout)}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("--watch-events: %w", err)
+	}
+	return &eventLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (l *eventLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+func (l *eventLog) emit(e watchEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Time = time.Now()
+	l.enc.Encode(e)
+}
+
+// change records that path was created or updated on remote.
+func (l *eventLog) change(remote Remote, path, action, itemize string) {
+	l.emit(watchEvent{Event: "change", Remote: remote.name, Path: path, Action: action, Itemize: itemize})
+}
+
+// synced records that a sync to remote finished.
+func (l *eventLog) synced(remote Remote) {
+	l.emit(watchEvent{Event: "synced", Remote: remote.name})
+}
+
+// itemizeLine matches a line of rsync --itemize-changes output: the flags,
+// then the name, which for a symlink is followed by " -> target". buildon
+// doesn't pass --delete, so there are no "*deleting" lines to match.
+var itemizeLine = regexp.MustCompile(`^([<>ch.][fdLDS][^ ]+) +(.+)$`)
+
+// parseItemize returns the file and action an itemized line describes.
+// Directories, and lines that aren't itemized, give ok false.
+func parseItemize(line string) (path, action, flags string, ok bool) {
+	m := itemizeLine.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", "", false
+	}
+	flags, path = m[1], m[2]
+	switch flags[1] {
+	case 'd':
+		return "", "", "", false
+	case 'L':
+		path, _, _ = strings.Cut(path, " -> ")
+	}
+	if strings.Trim(flags[2:], "+") == "" {
+		return path, "created", flags, true
+	}
+	return path, "updated", flags, true
+}
+
+// itemizeWriter passes rsync's output through to w, emitting a change event
+// for each itemized line.
+type itemizeWriter struct {
+	w      io.Writer
+	log    *eventLog
+	remote Remote
+	buf    []byte
+}
+
+func (iw *itemizeWriter) Write(p []byte) (int, error) {
+	iw.buf = append(iw.buf, p...)
+	for {
+		i := bytes.IndexByte(iw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if path, action, flags, ok := parseItemize(string(iw.buf[:i])); ok {
+			iw.log.change(iw.remote, path, action, flags)
+		}
+		iw.buf = iw.buf[i+1:]
+	}
+	return iw.w.Write(p)
+}
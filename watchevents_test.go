@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseItemize(t *testing.T) {
+	for _, tt := range []struct {
+		line, path, action string
+	}{
+		{line: "<f+++++++++ src/main.go", path: "src/main.go", action: "created"},
+		{line: "<f.st...... src/main.go", path: "src/main.go", action: "updated"},
+		{line: "<f..t...... name with spaces.txt", path: "name with spaces.txt", action: "updated"},
+		{line: "cL+++++++++ link -> target", path: "link", action: "created"},
+		{line: "cL.st...... link -> other", path: "link", action: "updated"},
+		{line: "cd+++++++++ src/"},
+		{line: ".d..t...... ./"},
+		{line: "sending incremental file list"},
+		{line: "sent 1,234 bytes  received 56 bytes  2,580.00 bytes/sec"},
+	} {
+		path, action, _, ok := parseItemize(tt.line)
+		if ok != (tt.path != "") || path != tt.path || action != tt.action {
+			t.Errorf("parseItemize(%q) = %q, %q, %v; want %q, %q", tt.line, path, action, ok, tt.path, tt.action)
+		}
+	}
+}
+
+// readEvents parses a --watch-events file.
+func readEvents(t *testing.T, file string) []watchEvent {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []watchEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var e watchEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad event line %q: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestItemizeWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "events.jsonl")
+	log, err := openEventLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	w := &itemizeWriter{w: &out, log: log, remote: Remote{name: "dev"}}
+	// rsync's output arrives in pieces that don't follow line breaks.
+	for _, p := range []string{"sending incremental file list\n<f+++", "++++++ a.txt\n<f.st...", "... b.txt\n"} {
+		w.Write([]byte(p))
+	}
+	log.Close()
+
+	if want := "sending incremental file list\n<f+++++++++ a.txt\n<f.st...... b.txt\n"; out.String() != want {
+		t.Errorf("output = %q, want it passed through as %q", out.String(), want)
+	}
+	events := readEvents(t, file)
+	if len(events) != 2 || events[0].Path != "a.txt" || events[0].Action != "created" ||
+		events[1].Path != "b.txt" || events[1].Action != "updated" || events[1].Itemize != "<f.st......" || events[1].Remote != "dev" {
+		t.Errorf("events = %+v, want a.txt created and b.txt updated on dev", events)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	host, port := sshServer(t)
+	t.Chdir(t.TempDir())
+	os.WriteFile("a.txt", []byte("a\n"), 0o644)
+	file := filepath.Join(t.TempDir(), "events.jsonl")
+
+	out := &lockedBuffer{}
+	remote := Remote{name: "dev", Host: host, Port: port, User: "u", Path: t.TempDir(), Transport: transportNative, out: out, errOut: out, detached: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- runWatch(ctx, remote, Options{NoGit: true, WatchEvents: file}, []string{"true"}, Project{})
+	}()
+
+	waitFor(t, "the first run", out, func() bool { return strings.Contains(out.String(), "==> Watching") })
+	os.WriteFile("a.txt", []byte("changed\n"), 0o644)
+	waitFor(t, "the second run", out, func() bool { return strings.Count(out.String(), "==> Watching") == 2 })
+	cancel()
+	<-done
+
+	var got []string
+	for _, e := range readEvents(t, file) {
+		if e.Remote != "dev" {
+			t.Errorf("event %+v isn't for remote dev", e)
+		}
+		got = append(got, strings.TrimSpace(e.Event+" "+e.Action+" "+e.Path))
+	}
+	if want := "change created a.txt|synced|change updated a.txt|synced"; strings.Join(got, "|") != want {
+		t.Errorf("events = %q, want %q", strings.Join(got, "|"), want)
+	}
+}